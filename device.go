@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"net"
+	"sort"
+	"sync"
 	"syscall"
 
 	"github.com/Sirupsen/logrus"
@@ -15,68 +18,234 @@ type vxlanDeviceAttrs struct {
 	vtepIndex int
 	vtepAddr  net.IP
 	vtepPort  int
-	gbp       bool
+	// portLow and portHigh bound the UDP source ports, left to the kernel
+	// when zero
+	portLow  int
+	portHigh int
+	udpCSum  bool
+	ttl      int
+	tos      int
+	gbp      bool
+	mtu      int
+	// hardwareAddr is left to the kernel when nil
+	hardwareAddr net.HardwareAddr
+	mode         string
+	// group is the multicast group in multicast mode
+	group net.IP
+	// overlay is routed through the device as a whole in miss mode
+	overlay *net.IPNet
+	// publicIP and localNet decide which address peers are reached on
+	publicIP IP4
+	localNet *net.IPNet
+	// bridge is the bridge the device is enslaved to in bridge mode, with
+	// gatewayMAC as its address
+	bridge     string
+	gatewayMAC net.HardwareAddr
+	// ipsecSecret enables encryption between VTEPs when set
+	ipsecSecret []byte
+	// ipsecNonce is published in our lease and changes whenever our SAs are
+	// installed afresh
+	ipsecNonce []byte
 }
 
 type vxlanDevice struct {
-	link          *netlink.Vxlan
+	nlh           netlinkHandle
 	directRouting bool
+	network       string
+	lease         IP4Net
+	addr          string
+
+	mu     sync.Mutex
+	attrs  vxlanDeviceAttrs
+	link   *netlink.Vxlan
+	bridge *netlink.Bridge
+	peers  map[IP4Net]*peer
+	synced bool
+	// missesWatched is set while handleMisses receives miss notifications
+	missesWatched bool
+	// endpoints are the workloads of peers in bridge mode, by MAC
+	endpoints map[string]*remoteEndpoint
 }
 
-func newVxlanDevice(devAttrs *vxlanDeviceAttrs) (*vxlanDevice, error) {
-	link := &netlink.Vxlan{
+// peer records what has been programmed for a remote subnet.
+type peer struct {
+	attrs   Attrs
+	arp     bool
+	fdb     bool
+	flood   bool
+	route   bool
+	ipsec   bool
+	lastErr error
+}
+
+func newVxlanDevice(nlh netlinkHandle, devAttrs *vxlanDeviceAttrs) (*vxlanDevice, error) {
+	link, err := ensureLink(nlh, newVxlanLink(devAttrs))
+	if err != nil {
+		return nil, err
+	}
+	dev := &vxlanDevice{
+		nlh:       nlh,
+		attrs:     *devAttrs,
+		link:      link,
+		peers:     make(map[IP4Net]*peer),
+		endpoints: make(map[string]*remoteEndpoint),
+	}
+	if devAttrs.ipsecSecret != nil {
+		if err := dev.flushIPsecSAs(); err != nil {
+			return nil, err
+		}
+	}
+	return dev, nil
+}
+
+func newVxlanLink(devAttrs *vxlanDeviceAttrs) *netlink.Vxlan {
+	return &netlink.Vxlan{
 		LinkAttrs: netlink.LinkAttrs{
-			Name: devAttrs.name,
+			Name:         devAttrs.name,
+			MTU:          devAttrs.mtu,
+			HardwareAddr: devAttrs.hardwareAddr,
 		},
 		VxlanId:      int(devAttrs.vni),
 		VtepDevIndex: devAttrs.vtepIndex,
 		SrcAddr:      devAttrs.vtepAddr,
 		Port:         devAttrs.vtepPort,
-		Learning:     false,
+		PortLow:      devAttrs.portLow,
+		PortHigh:     devAttrs.portHigh,
+		UDPCSum:      devAttrs.udpCSum,
+		TTL:          devAttrs.ttl,
+		TOS:          devAttrs.tos,
+		Group:        devAttrs.group,
+		Learning:     devAttrs.mode == modeMulticast || devAttrs.mode == modeFlood || devAttrs.mode == modeBridge,
+		L2miss:       devAttrs.mode == modeMiss,
+		L3miss:       devAttrs.mode == modeMiss,
+		Proxy:        devAttrs.mode == modeBridge,
 		GBP:          devAttrs.gbp,
 	}
+}
+
+// recreate ensures the device matches devAttrs, recreating it if needed,
+// restores its address and replays all known peers onto it.
+func (dev *vxlanDevice) recreate(devAttrs *vxlanDeviceAttrs) error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	defer dev.updatePeerMetrics()
 
-	link, err := ensureLink(link)
+	link, err := ensureLink(dev.nlh, newVxlanLink(devAttrs))
 	if err != nil {
-		return nil, err
+		return err
+	}
+	dev.link = link
+
+	if dev.attrs.ipsecSecret != nil && (!dev.attrs.vtepAddr.Equal(devAttrs.vtepAddr) || !bytes.Equal(dev.attrs.ipsecNonce, devAttrs.ipsecNonce)) {
+		// the SAs and policies are bound to our old address and nonce
+		for sn, p := range dev.peers {
+			if !p.ipsec {
+				continue
+			}
+			if err := dev.delPeerIPsec(dev.attrs.vtepAddr, sn, p); err != nil {
+				logrus.Error("delPeerIPsec failed: ", err)
+			}
+		}
+	}
+	dev.attrs = *devAttrs
+
+	if err := dev.configure(dev.addr); err != nil {
+		return err
+	}
+
+	logrus.Infof("replaying %v peers onto %s", len(dev.peers), link.Name)
+	for sn, p := range dev.peers {
+		dev.addPeer(sn, p.attrs)
 	}
-	return &vxlanDevice{
-		link: link,
-	}, nil
+
+	return nil
+}
+
+func (dev *vxlanDevice) deviceAttrs() vxlanDeviceAttrs {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return dev.attrs
 }
 
-func ensureLink(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
-	err := netlink.LinkAdd(vxlan)
+// linkIntact reports whether the device we programmed still exists and is up,
+// and in bridge mode is still enslaved to our bridge.
+func (dev *vxlanDevice) linkIntact() bool {
+	vxlan := dev.vxlanLink()
+	link, err := dev.nlh.LinkByName(vxlan.Name)
+	if err != nil {
+		return false
+	}
+
+	if br := dev.bridgeLink(); br != nil && link.Attrs().MasterIndex != br.Index {
+		return false
+	}
+
+	return link.Attrs().Index == vxlan.Index && link.Attrs().Flags&net.FlagUp != 0
+}
+
+func (dev *vxlanDevice) linkName() string {
+	return dev.deviceAttrs().name
+}
+
+// vxlanLink returns the current link of the device.
+func (dev *vxlanDevice) vxlanLink() *netlink.Vxlan {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return dev.link
+}
+
+// bridgeLink returns the bridge of the device, nil outside bridge mode.
+func (dev *vxlanDevice) bridgeLink() *netlink.Bridge {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return dev.bridge
+}
+
+func ensureLink(nlh netlinkHandle, vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
+	err := nlh.LinkAdd(vxlan)
 	if err == syscall.EEXIST {
 		// it's ok if the device already exists as long as config is similar
 		logrus.Infof("VXLAN device already exists")
-		existing, err := netlink.LinkByName(vxlan.Name)
+		existing, err := nlh.LinkByName(vxlan.Name)
 		if err != nil {
 			return nil, err
 		}
 
 		incompat := vxlanLinksIncompat(vxlan, existing)
 		if incompat == "" {
-			logrus.Infof("Returning existing device")
-			return existing.(*netlink.Vxlan), nil
-		}
+			changes := vxlanLinksChanges(vxlan, existing)
+			if changes == "" {
+				logrus.Infof("Returning existing device")
+				return existing.(*netlink.Vxlan), nil
+			}
 
-		// delete existing
-		logrus.Warningf("%q already exists with incompatable configuration: %v; recreating device", vxlan.Name, incompat)
-		if err = netlink.LinkDel(existing); err != nil {
-			return nil, fmt.Errorf("failed to delete interface: %v", err)
+			// update existing in place, keeping its neighbors and routes
+			logrus.Infof("%q already exists with different configuration: %v; updating device", vxlan.Name, changes)
+			if err = updateVxlanLink(nlh, existing.(*netlink.Vxlan), vxlan); err == nil {
+				vxlan.Index = existing.Attrs().Index
+			} else {
+				incompat = fmt.Sprintf("update failed: %v", err)
+			}
 		}
 
-		// create new
-		if err = netlink.LinkAdd(vxlan); err != nil {
-			return nil, fmt.Errorf("failed to create vxlan interface: %v", err)
+		if incompat != "" {
+			// delete existing
+			logrus.Warningf("%q already exists with incompatable configuration: %v; recreating device", vxlan.Name, incompat)
+			if err = nlh.LinkDel(existing); err != nil {
+				return nil, fmt.Errorf("failed to delete interface: %v", err)
+			}
+
+			// create new
+			if err = nlh.LinkAdd(vxlan); err != nil {
+				return nil, fmt.Errorf("failed to create vxlan interface: %v", err)
+			}
 		}
 	} else if err != nil {
 		return nil, err
 	}
 
 	ifindex := vxlan.Index
-	link, err := netlink.LinkByIndex(vxlan.Index)
+	link, err := nlh.LinkByIndex(vxlan.Index)
 	if err != nil {
 		return nil, fmt.Errorf("can't locate created vxlan device with index %v", ifindex)
 	}
@@ -89,6 +258,56 @@ func ensureLink(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
 	return vxlan, nil
 }
 
+// updateVxlanLink changes the attributes of existing listed by
+// vxlanLinksChanges to those of vxlan.
+func updateVxlanLink(nlh netlinkHandle, existing, vxlan *netlink.Vxlan) error {
+	if vxlan.MTU > 0 && vxlan.MTU != existing.MTU {
+		if err := nlh.LinkSetMTU(existing, vxlan.MTU); err != nil {
+			return fmt.Errorf("failed to set MTU: %v", err)
+		}
+	}
+
+	rest := *vxlan
+	rest.MTU = existing.MTU
+	if vxlanLinksChanges(&rest, existing) == "" {
+		return nil
+	}
+
+	return nlh.VxlanChange(&netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{Index: existing.Index, Name: existing.Name},
+		TTL:       vxlan.TTL,
+		TOS:       vxlan.TOS,
+		Learning:  vxlan.Learning,
+		Age:       vxlan.Age,
+		Limit:     vxlan.Limit,
+	})
+}
+
+// ensureBridge returns the bridge named name, creating it if needed.
+func ensureBridge(nlh netlinkHandle, name string, mac net.HardwareAddr) (*netlink.Bridge, error) {
+	err := nlh.LinkAdd(&netlink.Bridge{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:         name,
+			HardwareAddr: mac,
+		},
+	})
+	if err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("failed to create bridge %s: %v", name, err)
+	}
+
+	link, err := nlh.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't locate bridge %s: %v", name, err)
+	}
+
+	br, ok := link.(*netlink.Bridge)
+	if !ok {
+		return nil, fmt.Errorf("%s already exists and is a %s, not a bridge", name, link.Type())
+	}
+
+	return br, nil
+}
+
 func vxlanLinksIncompat(l1, l2 netlink.Link) string {
 	if l1.Type() != l2.Type() {
 		return fmt.Sprintf("link type: %v vs %v", l1.Type(), l2.Type())
@@ -101,6 +320,10 @@ func vxlanLinksIncompat(l1, l2 netlink.Link) string {
 		return fmt.Sprintf("vni: %v vs %v", v1.VxlanId, v2.VxlanId)
 	}
 
+	if len(v1.HardwareAddr) > 0 && !bytes.Equal(v1.HardwareAddr, v2.HardwareAddr) {
+		return fmt.Sprintf("mac: %v vs %v", v1.HardwareAddr, v2.HardwareAddr)
+	}
+
 	if v1.VtepDevIndex > 0 && v2.VtepDevIndex > 0 && v1.VtepDevIndex != v2.VtepDevIndex {
 		return fmt.Sprintf("vtep (external) interface: %v vs %v", v1.VtepDevIndex, v2.VtepDevIndex)
 	}
@@ -117,81 +340,543 @@ func vxlanLinksIncompat(l1, l2 netlink.Link) string {
 		return fmt.Sprintf("l2miss: %v vs %v", v1.L2miss, v2.L2miss)
 	}
 
-	if v1.Port > 0 && v2.Port > 0 && v1.Port != v2.Port {
-		return fmt.Sprintf("port: %v vs %v", v1.Port, v2.Port)
+	if v1.L3miss != v2.L3miss {
+		return fmt.Sprintf("l3miss: %v vs %v", v1.L3miss, v2.L3miss)
+	}
+
+	if v1.Proxy != v2.Proxy {
+		return fmt.Sprintf("proxy: %v vs %v", v1.Proxy, v2.Proxy)
+	}
+
+	if v1.RSC != v2.RSC {
+		return fmt.Sprintf("rsc: %v vs %v", v1.RSC, v2.RSC)
+	}
+
+	// an unset port is the kernel default, which the kernel reports as such
+	if vxlanPort(v1.Port) != vxlanPort(v2.Port) {
+		return fmt.Sprintf("port: %v vs %v", vxlanPort(v1.Port), vxlanPort(v2.Port))
+	}
+
+	if (v1.PortLow > 0 || v1.PortHigh > 0) && (v1.PortLow != v2.PortLow || v1.PortHigh != v2.PortHigh) {
+		return fmt.Sprintf("port range: %v-%v vs %v-%v", v1.PortLow, v1.PortHigh, v2.PortLow, v2.PortHigh)
+	}
+
+	if v1.UDPCSum != v2.UDPCSum {
+		return fmt.Sprintf("udp checksum: %v vs %v", v1.UDPCSum, v2.UDPCSum)
+	}
+
+	if v1.UDP6ZeroCSumTx != v2.UDP6ZeroCSumTx {
+		return fmt.Sprintf("udp6 zero checksum tx: %v vs %v", v1.UDP6ZeroCSumTx, v2.UDP6ZeroCSumTx)
+	}
+
+	if v1.UDP6ZeroCSumRx != v2.UDP6ZeroCSumRx {
+		return fmt.Sprintf("udp6 zero checksum rx: %v vs %v", v1.UDP6ZeroCSumRx, v2.UDP6ZeroCSumRx)
 	}
 
 	if v1.GBP != v2.GBP {
 		return fmt.Sprintf("gbp: %v vs %v", v1.GBP, v2.GBP)
 	}
 
+	if v1.FlowBased != v2.FlowBased {
+		return fmt.Sprintf("flow based: %v vs %v", v1.FlowBased, v2.FlowBased)
+	}
+
+	return ""
+}
+
+// vxlanLinksChanges compares the attributes the kernel allows changing on an
+// existing vxlan device. Zero values in the desired link l1 leave the kernel
+// default alone.
+func vxlanLinksChanges(l1, l2 netlink.Link) string {
+	v1 := l1.(*netlink.Vxlan)
+	v2 := l2.(*netlink.Vxlan)
+
+	if v1.MTU > 0 && v1.MTU != v2.MTU {
+		return fmt.Sprintf("mtu: %v vs %v", v1.MTU, v2.MTU)
+	}
+
+	if v1.TTL != v2.TTL {
+		return fmt.Sprintf("ttl: %v vs %v", v1.TTL, v2.TTL)
+	}
+
+	if v1.TOS != v2.TOS {
+		return fmt.Sprintf("tos: %v vs %v", v1.TOS, v2.TOS)
+	}
+
+	if v1.Learning != v2.Learning {
+		return fmt.Sprintf("learning: %v vs %v", v1.Learning, v2.Learning)
+	}
+
+	if v1.Age > 0 && v1.Age != v2.Age {
+		return fmt.Sprintf("ageing: %v vs %v", v1.Age, v2.Age)
+	}
+
+	if v1.Limit > 0 && v1.Limit != v2.Limit {
+		return fmt.Sprintf("limit: %v vs %v", v1.Limit, v2.Limit)
+	}
+
 	return ""
 }
 
 func (dev *vxlanDevice) configure(ipn string) error {
-	if err := ensureV4AddressOnLink(ipn, dev.link); err != nil {
-		return fmt.Errorf("failed to ensure address of interface %s: %s", dev.link.Attrs().Name, err)
+	dev.addr = ipn
+
+	var addrLink netlink.Link = dev.link
+	if dev.attrs.mode == modeBridge {
+		br, err := ensureBridge(dev.nlh, dev.attrs.bridge, dev.attrs.gatewayMAC)
+		if err != nil {
+			return err
+		}
+		if err := dev.nlh.LinkSetMasterByIndex(dev.link, br.Index); err != nil {
+			return fmt.Errorf("failed to attach %s to bridge %s: %s", dev.link.Attrs().Name, br.Name, err)
+		}
+		if err := dev.nlh.LinkSetUp(br); err != nil {
+			return fmt.Errorf("failed to set bridge %s to UP state: %s", br.Name, err)
+		}
+		dev.bridge = br
+		addrLink = br
+	}
+
+	if err := ensureV4AddressOnLink(dev.nlh, ipn, addrLink); err != nil {
+		return fmt.Errorf("failed to ensure address of interface %s: %s", addrLink.Attrs().Name, err)
 	}
 
-	if err := netlink.LinkSetUp(dev.link); err != nil {
+	if err := dev.nlh.LinkSetUp(dev.link); err != nil {
 		return fmt.Errorf("failed to set interface %s to UP state: %s", dev.link.Attrs().Name, err)
 	}
 
+	if dev.attrs.mode == modeMiss {
+		// a single route for the whole overlay; the kernel ARPs for every
+		// destination and reports the misses to us
+		route := netlink.Route{
+			LinkIndex: dev.link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       dev.attrs.overlay,
+		}
+		if err := dev.nlh.RouteReplace(&route); err != nil {
+			return fmt.Errorf("failed to add route %s to %s: %s", dev.attrs.overlay, dev.link.Attrs().Name, err)
+		}
+	}
+
 	return nil
 }
 
-func (dev *vxlanDevice) handleSubnetEvents(batch []Event) {
+// handleSubnetEvents applies a batch of subnet events. A snapshot replaces
+// all known peers: those missing from it were removed while we weren't
+// watching.
+func (dev *vxlanDevice) handleSubnetEvents(batch []Event, snapshot bool) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	defer dev.updatePeerMetrics()
+
+	// the first batch is always the initial snapshot of the registry
+	dev.synced = true
+
+	if snapshot {
+		seen := map[IP4Net]bool{}
+		for _, e := range batch {
+			seen[e.Subnet] = true
+		}
+		for sn := range dev.peers {
+			if !seen[sn] {
+				dev.removeLease(sn)
+			}
+		}
+	}
+
 	for _, event := range batch {
-		sn := event.Subnet
-		attrs := event.Attrs
+		switch event.Type {
+		case eventAdd:
+			dev.addPeer(event.Subnet, event.Attrs)
+		case eventRemove:
+			dev.removeLease(event.Subnet)
+		default:
+			logrus.Infof("invalid event type: %v\n", event.Type)
+		}
+	}
+}
 
-		// This route is used when traffic should be vxlan encapsulated
-		vxlanRoute := netlink.Route{
-			LinkIndex: dev.link.Attrs().Index,
-			Scope:     netlink.SCOPE_UNIVERSE,
-			Dst:       sn.ToIPNet(),
-			Gw:        sn.IP.ToIP(),
+// addPeer programs the ARP, FDB and route entries for a remote subnet. The
+// caller must hold dev.mu.
+func (dev *vxlanDevice) addPeer(sn IP4Net, attrs Attrs) {
+	if old, ok := dev.peers[sn]; ok && (old.attrs.PublicIP != attrs.PublicIP || old.attrs.VtepIP != attrs.VtepIP || old.attrs.Port != attrs.Port || !bytes.Equal(old.attrs.HardwareAddr, attrs.HardwareAddr) || !bytes.Equal(old.attrs.IPsecNonce, attrs.IPsecNonce)) {
+		// the peer moved or restarted, don't leave entries pointing at its
+		// old location or SAs keyed for its previous run
+		dev.removePeer(sn)
+	}
+
+	vxlanRoute := dev.peerRoute(sn)
+
+	vtepIP := dev.peerVtepIP(attrs)
+	logrus.Infof("adding subnet: %s PublicIP: %s VtepIP: %s VtepMAC: %s", sn.StringSep(".", "/"), attrs.PublicIP.ToIP(), vtepIP, net.HardwareAddr(attrs.HardwareAddr))
+	p := &peer{attrs: attrs}
+	dev.peers[sn] = p
+
+	if port := vxlanPort(attrs.Port); port != vxlanPort(dev.attrs.vtepPort) {
+		// the device sends to a single port, the peer would never see our packets
+		err := fmt.Errorf("peer listens on UDP port %v, we send to %v", port, vxlanPort(dev.attrs.vtepPort))
+		observeOp(dev.network, "CheckPort", err)
+		logrus.Errorf("not programming subnet %s: %v", sn.StringSep(".", "/"), err)
+		p.lastErr = err
+		return
+	}
+
+	if dev.attrs.ipsecSecret != nil {
+		if len(attrs.IPsecNonce) == 0 {
+			// keys derived without it would be reused across the peer's runs
+			err := fmt.Errorf("peer publishes no IPsec nonce")
+			observeOp(dev.network, "AddIPsec", err)
+			logrus.Errorf("not programming subnet %s: %v", sn.StringSep(".", "/"), err)
+			p.lastErr = err
+			return
 		}
-		vxlanRoute.SetFlag(syscall.RTNH_F_ONLINK)
 
-		if event.Type == eventAdd {
-			logrus.Infof("adding subnet: %s PublicIP: %s VtepMAC: %s", sn.StringSep(".", "/"), attrs.PublicIP.ToIP(), net.HardwareAddr(attrs.HardwareAddr))
-			if err := dev.AddARP(neighbor{IP: sn.IP.ToIP(), MAC: net.HardwareAddr(attrs.HardwareAddr)}); err != nil {
-				logrus.Error("AddARP failed: ", err)
-				continue
+		// never send to the peer in cleartext
+		err := dev.addPeerIPsec(sn, p)
+		observeOp(dev.network, "AddIPsec", err)
+		if err != nil {
+			logrus.Error("addPeerIPsec failed: ", err)
+			p.lastErr = err
+			if err := dev.delPeerIPsec(dev.attrs.vtepAddr, sn, p); err != nil {
+				logrus.Error("delPeerIPsec failed: ", err)
 			}
+			return
+		}
+		p.ipsec = true
+	}
 
-			if err := dev.AddFDB(neighbor{IP: attrs.PublicIP.ToIP(), MAC: net.HardwareAddr(attrs.HardwareAddr)}); err != nil {
-				logrus.Error("AddFDB failed: ", err)
+	if dev.attrs.mode == modeMiss {
+		// answered on demand from the peer table, see handleMisses
+		return
+	}
 
-				// Try to clean up the ARP entry then continue
-				if err := dev.DelARP(neighbor{IP: sn.IP.ToIP(), MAC: net.HardwareAddr(attrs.HardwareAddr)}); err != nil {
-					logrus.Error("DelARP failed: ", err)
-				}
+	if dev.staticNeighbors() {
+		err := dev.AddARP(neighbor{IP: sn.IP.ToIP(), MAC: net.HardwareAddr(attrs.HardwareAddr)})
+		observeOp(dev.network, "AddARP", err)
+		if err != nil {
+			logrus.Error("AddARP failed: ", err)
+			p.lastErr = err
+			return
+		}
+		p.arp = true
 
-				continue
-			}
+		err = dev.AddFDB(neighbor{IP: vtepIP, MAC: net.HardwareAddr(attrs.HardwareAddr)})
+		observeOp(dev.network, "AddFDB", err)
+		if err != nil {
+			logrus.Error("AddFDB failed: ", err)
+			p.lastErr = err
 
-			// Set the route - the kernel would ARP for the Gw IP address if it hadn't already been set above so make sure
-			// this is done last.
-			if err := netlink.RouteReplace(&vxlanRoute); err != nil {
-				logrus.Errorf("failed to add vxlanRoute (%s -> %s): %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
+			// Try to clean up the ARP entry then return
+			dev.cleanupPeer(sn, p, vtepIP)
+			return
+		}
+		p.fdb = true
+	}
 
-				// Try to clean up both the ARP and FDB entries then continue
-				if err := dev.DelARP(neighbor{IP: sn.IP.ToIP(), MAC: net.HardwareAddr(attrs.HardwareAddr)}); err != nil {
-					logrus.Error("DelARP failed: ", err)
-				}
+	if dev.floods() {
+		err := dev.AddFloodFDB(vtepIP)
+		observeOp(dev.network, "AddFloodFDB", err)
+		if err != nil {
+			logrus.Error("AddFloodFDB failed: ", err)
+			p.lastErr = err
+			return
+		}
+		p.flood = true
+	}
 
-				if err := dev.DelFDB(neighbor{IP: attrs.PublicIP.ToIP(), MAC: net.HardwareAddr(attrs.HardwareAddr)}); err != nil {
-					logrus.Error("DelFDB failed: ", err)
-				}
+	if !dev.routes() {
+		// bridge mode: the network is one L2 segment, nothing to route, but
+		// the peer's workloads can be programmed now
+		dev.peerEndpoints(sn, func(re *remoteEndpoint) {
+			dev.programEndpoint(re, p)
+		})
+		return
+	}
 
-				continue
-			}
+	// Set the route - the kernel would ARP for the Gw IP address if it hadn't already been set above so make sure
+	// this is done last.
+	err := dev.nlh.RouteReplace(&vxlanRoute)
+	observeOp(dev.network, "RouteReplace", err)
+	if err != nil {
+		logrus.Errorf("failed to add vxlanRoute (%s -> %s): %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
+		p.lastErr = err
+
+		// Try to clean up both the ARP and FDB entries then return
+		dev.cleanupPeer(sn, p, vtepIP)
+		return
+	}
+	p.route = true
+}
+
+// peerRoute returns the route used when traffic to sn should be vxlan
+// encapsulated.
+func (dev *vxlanDevice) peerRoute(sn IP4Net) netlink.Route {
+	vxlanRoute := netlink.Route{
+		LinkIndex: dev.link.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       sn.ToIPNet(),
+		Gw:        sn.IP.ToIP(),
+	}
+	vxlanRoute.SetFlag(syscall.RTNH_F_ONLINK)
+	return vxlanRoute
+}
+
+// removePeer removes everything programmed for a remote subnet. The caller
+// must hold dev.mu.
+func (dev *vxlanDevice) removePeer(sn IP4Net) {
+	p, ok := dev.peers[sn]
+	if !ok {
+		return
+	}
+	delete(dev.peers, sn)
+	dev.peerEndpoints(sn, dev.unprogramEndpoint)
+
+	vtepIP := dev.peerVtepIP(p.attrs)
+	logrus.Infof("removing subnet: %s PublicIP: %s VtepIP: %s VtepMAC: %s", sn.StringSep(".", "/"), p.attrs.PublicIP.ToIP(), vtepIP, p.attrs.HardwareAddr)
+
+	if p.route {
+		vxlanRoute := dev.peerRoute(sn)
+		err := dev.nlh.RouteDel(&vxlanRoute)
+		observeOp(dev.network, "RouteDel", err)
+		if err != nil {
+			logrus.Errorf("failed to delete vxlanRoute (%s -> %s): %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
+		}
+	}
+
+	dev.cleanupPeer(sn, p, vtepIP)
+}
+
+// cleanupPeer removes the ARP and FDB entries programmed for p so far.
+func (dev *vxlanDevice) cleanupPeer(sn IP4Net, p *peer, vtepIP net.IP) {
+	if p.arp {
+		if err := dev.DelARP(neighbor{IP: sn.IP.ToIP(), MAC: net.HardwareAddr(p.attrs.HardwareAddr)}); err != nil {
+			logrus.Error("DelARP failed: ", err)
 		} else {
-			logrus.Infof("invalid event type: %v\n", event.Type)
+			p.arp = false
 		}
 	}
+
+	if p.fdb {
+		if err := dev.DelFDB(neighbor{IP: vtepIP, MAC: net.HardwareAddr(p.attrs.HardwareAddr)}); err != nil {
+			logrus.Error("DelFDB failed: ", err)
+		} else {
+			p.fdb = false
+		}
+	}
+
+	if p.flood {
+		if err := dev.DelFloodFDB(vtepIP); err != nil {
+			logrus.Error("DelFloodFDB failed: ", err)
+		} else {
+			p.flood = false
+		}
+	}
+
+	if p.ipsec {
+		if err := dev.delPeerIPsec(dev.attrs.vtepAddr, sn, p); err != nil {
+			logrus.Error("delPeerIPsec failed: ", err)
+		} else {
+			p.ipsec = false
+		}
+	}
+}
+
+// vxlanPort returns the UDP destination port used for port, where zero is
+// the kernel default.
+func vxlanPort(port int) int {
+	if port == 0 {
+		return defaultVxlanPort
+	}
+	return port
+}
+
+// staticNeighbors reports whether ARP and FDB entries are programmed per
+// peer. In multicast and flood mode the kernel floods and learns them.
+func (dev *vxlanDevice) staticNeighbors() bool {
+	return dev.attrs.mode == modeUnicast
+}
+
+// floods reports whether an all-zeros FDB entry is programmed per peer.
+func (dev *vxlanDevice) floods() bool {
+	return dev.attrs.mode == modeFlood || dev.attrs.mode == modeBridge
+}
+
+// routes reports whether a route is programmed per peer.
+func (dev *vxlanDevice) routes() bool {
+	return dev.attrs.mode != modeMiss && dev.attrs.mode != modeBridge
+}
+
+// programmed reports whether everything the mode needs is in place for p.
+func (dev *vxlanDevice) programmed(p *peer) bool {
+	if vxlanPort(p.attrs.Port) != vxlanPort(dev.attrs.vtepPort) {
+		return false
+	}
+	if dev.attrs.ipsecSecret != nil && !p.ipsec {
+		return false
+	}
+	if dev.attrs.mode == modeMiss {
+		return true
+	}
+	if dev.routes() && !p.route {
+		return false
+	}
+	if dev.floods() {
+		return p.flood
+	}
+	return !dev.staticNeighbors() || (p.arp && p.fdb)
+}
+
+// peerVtepIP returns the address vxlan packets to the peer are sent to. Peers
+// behind the same NAT as us, or directly on our external network, are reached
+// on their private address; everyone else on their public one.
+func (dev *vxlanDevice) peerVtepIP(attrs Attrs) net.IP {
+	return peerAddr(attrs, dev.attrs.publicIP, dev.attrs.localNet)
+}
+
+// peerAddr picks the private or public address of the peer described by
+// attrs as seen from a node with publicIP on localNet.
+func peerAddr(attrs Attrs, publicIP IP4, localNet *net.IPNet) net.IP {
+	if attrs.VtepIP == 0 || attrs.VtepIP == attrs.PublicIP {
+		return attrs.PublicIP.ToIP()
+	}
+
+	if attrs.PublicIP == publicIP {
+		return attrs.VtepIP.ToIP()
+	}
+	if localNet != nil && localNet.Contains(attrs.VtepIP.ToIP()) {
+		return attrs.VtepIP.ToIP()
+	}
+
+	return attrs.PublicIP.ToIP()
+}
+
+func (dev *vxlanDevice) updatePeerMetrics() {
+	var arp, fdb, flood, routes, ipsec int
+	for _, p := range dev.peers {
+		if p.arp {
+			arp++
+		}
+		if p.fdb {
+			fdb++
+		}
+		if p.flood {
+			flood++
+		}
+		if p.route {
+			routes++
+		}
+		if p.ipsec {
+			ipsec++
+		}
+	}
+
+	var endpoints int
+	for _, re := range dev.endpoints {
+		if re.fdb && re.arp {
+			endpoints++
+		}
+	}
+
+	peersGauge.WithLabelValues(dev.network).Set(float64(len(dev.peers)))
+	programmedEntriesGauge.WithLabelValues(dev.network, "arp").Set(float64(arp))
+	programmedEntriesGauge.WithLabelValues(dev.network, "fdb").Set(float64(fdb))
+	programmedEntriesGauge.WithLabelValues(dev.network, "flood_fdb").Set(float64(flood))
+	programmedEntriesGauge.WithLabelValues(dev.network, "route").Set(float64(routes))
+	programmedEntriesGauge.WithLabelValues(dev.network, "ipsec").Set(float64(ipsec))
+	programmedEntriesGauge.WithLabelValues(dev.network, "endpoint").Set(float64(endpoints))
+}
+
+// peerStatuses returns a snapshot of the peer table.
+func (dev *vxlanDevice) peerStatuses() []peerStatus {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	peers := make([]peerStatus, 0, len(dev.peers))
+	for sn, p := range dev.peers {
+		ps := peerStatus{
+			Subnet:   sn.StringSep(".", "/"),
+			PublicIP: p.attrs.PublicIP.ToIP().String(),
+			VtepIP:   dev.peerVtepIP(p.attrs).String(),
+			VtepMAC:  p.attrs.HardwareAddr.String(),
+			ARP:      p.arp,
+			FDB:      p.fdb,
+			Flood:    p.flood,
+			Route:    p.route,
+			IPsec:    p.ipsec,
+		}
+		if p.lastErr != nil {
+			ps.LastError = p.lastErr.Error()
+		}
+		peers = append(peers, ps)
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Subnet < peers[j].Subnet })
+	return peers
+}
+
+// checkReady verifies that the device is up with its address and that the
+// initial snapshot of peers has been fully programmed.
+func (dev *vxlanDevice) checkReady() error {
+	vxlan := dev.vxlanLink()
+	link, err := dev.nlh.LinkByIndex(vxlan.Index)
+	if err != nil {
+		return fmt.Errorf("failed to find %s: %v", vxlan.Name, err)
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("%s is not up", vxlan.Name)
+	}
+
+	if br := dev.bridgeLink(); br != nil {
+		if link.Attrs().MasterIndex != br.Index {
+			return fmt.Errorf("%s is not attached to bridge %s", vxlan.Name, br.Name)
+		}
+		if link, err = dev.nlh.LinkByIndex(br.Index); err != nil {
+			return fmt.Errorf("failed to find %s: %v", br.Name, err)
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			return fmt.Errorf("%s is not up", br.Name)
+		}
+	}
+
+	dev.mu.Lock()
+	addr := dev.addr
+	dev.mu.Unlock()
+
+	name := link.Attrs().Name
+	want, err := netlink.ParseAddr(addr)
+	if err != nil {
+		return fmt.Errorf("%s is not configured", name)
+	}
+	addrs, err := dev.nlh.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr.Equal(*want) {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s does not have address %s", name, addr)
+	}
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	if !dev.synced {
+		return fmt.Errorf("initial subnets not handled yet")
+	}
+	if dev.attrs.mode == modeMiss && !dev.missesWatched {
+		return fmt.Errorf("not subscribed to miss notifications")
+	}
+	for sn, p := range dev.peers {
+		if !dev.programmed(p) {
+			return fmt.Errorf("subnet %s not fully programmed", sn.StringSep(".", "/"))
+		}
+	}
+
+	return nil
 }
 
 type neighbor struct {
@@ -201,7 +886,7 @@ type neighbor struct {
 
 func (dev *vxlanDevice) AddFDB(n neighbor) error {
 	logrus.Infof("calling AddFDB: %v, %v", n.IP, n.MAC)
-	return netlink.NeighSet(&netlink.Neigh{
+	return dev.nlh.NeighSet(&netlink.Neigh{
 		LinkIndex:    dev.link.Index,
 		State:        netlink.NUD_PERMANENT,
 		Family:       syscall.AF_BRIDGE,
@@ -213,7 +898,7 @@ func (dev *vxlanDevice) AddFDB(n neighbor) error {
 
 func (dev *vxlanDevice) DelFDB(n neighbor) error {
 	logrus.Infof("calling DelFDB: %v, %v", n.IP, n.MAC)
-	return netlink.NeighDel(&netlink.Neigh{
+	return dev.nlh.NeighDel(&netlink.Neigh{
 		LinkIndex:    dev.link.Index,
 		Family:       syscall.AF_BRIDGE,
 		Flags:        netlink.NTF_SELF,
@@ -222,9 +907,36 @@ func (dev *vxlanDevice) DelFDB(n neighbor) error {
 	})
 }
 
+// floodMAC is the all-zeros MAC of the FDB entries that make the device
+// replicate broadcast and unknown unicast frames to every listed remote.
+var floodMAC = net.HardwareAddr{0, 0, 0, 0, 0, 0}
+
+func (dev *vxlanDevice) AddFloodFDB(remote net.IP) error {
+	logrus.Infof("calling AddFloodFDB: %v", remote)
+	return dev.nlh.NeighAppend(&netlink.Neigh{
+		LinkIndex:    dev.link.Index,
+		State:        netlink.NUD_PERMANENT,
+		Family:       syscall.AF_BRIDGE,
+		Flags:        netlink.NTF_SELF,
+		IP:           remote,
+		HardwareAddr: floodMAC,
+	})
+}
+
+func (dev *vxlanDevice) DelFloodFDB(remote net.IP) error {
+	logrus.Infof("calling DelFloodFDB: %v", remote)
+	return dev.nlh.NeighDel(&netlink.Neigh{
+		LinkIndex:    dev.link.Index,
+		Family:       syscall.AF_BRIDGE,
+		Flags:        netlink.NTF_SELF,
+		IP:           remote,
+		HardwareAddr: floodMAC,
+	})
+}
+
 func (dev *vxlanDevice) AddARP(n neighbor) error {
 	logrus.Infof("calling AddARP: %v, %v", n.IP, n.MAC)
-	return netlink.NeighSet(&netlink.Neigh{
+	return dev.nlh.NeighSet(&netlink.Neigh{
 		LinkIndex:    dev.link.Index,
 		State:        netlink.NUD_PERMANENT,
 		Type:         syscall.RTN_UNICAST,
@@ -235,7 +947,7 @@ func (dev *vxlanDevice) AddARP(n neighbor) error {
 
 func (dev *vxlanDevice) DelARP(n neighbor) error {
 	logrus.Infof("calling DelARP: %v, %v", n.IP, n.MAC)
-	return netlink.NeighDel(&netlink.Neigh{
+	return dev.nlh.NeighDel(&netlink.Neigh{
 		LinkIndex:    dev.link.Index,
 		State:        netlink.NUD_PERMANENT,
 		Type:         syscall.RTN_UNICAST,
@@ -246,13 +958,13 @@ func (dev *vxlanDevice) DelARP(n neighbor) error {
 
 // ensureV4AddressOnLink ensures that there is only one v4 Addr on `link` and it equals `ipn`.
 // If there exist multiple addresses on link, it returns an error message to tell callers to remove additional address.
-func ensureV4AddressOnLink(ipn string, link netlink.Link) error {
+func ensureV4AddressOnLink(nlh netlinkHandle, ipn string, link netlink.Link) error {
 	addr, err := netlink.ParseAddr(ipn)
 	if err != nil {
 		return fmt.Errorf("parse address error: %v", err)
 	}
 
-	existingAddrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	existingAddrs, err := nlh.AddrList(link, netlink.FAMILY_V4)
 	if err != nil {
 		return err
 	}
@@ -264,7 +976,7 @@ func ensureV4AddressOnLink(ipn string, link netlink.Link) error {
 
 	// If the device has an incompatible address then delete it. This can happen if the lease changes for example.
 	if len(existingAddrs) == 1 && !existingAddrs[0].Equal(*addr) {
-		if err := netlink.AddrDel(link, &existingAddrs[0]); err != nil {
+		if err := nlh.AddrDel(link, &existingAddrs[0]); err != nil {
 			return fmt.Errorf("failed to remove IP address %s from %s: %s", ipn, link.Attrs().Name, err)
 		}
 		existingAddrs = []netlink.Addr{}
@@ -272,7 +984,7 @@ func ensureV4AddressOnLink(ipn string, link netlink.Link) error {
 
 	// Actually add the desired address to the interface if needed.
 	if len(existingAddrs) == 0 {
-		if err := netlink.AddrAdd(link, addr); err != nil {
+		if err := nlh.AddrAdd(link, addr); err != nil {
 			return fmt.Errorf("failed to add IP address %s to %s: %s", ipn, link.Attrs().Name, err)
 		}
 	}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	testPeerSn = IP4Net{IP: FromIP(net.IPv4(10, 5, 2, 0)), PrefixLen: 24}
+	testPeer   = Attrs{
+		PublicIP:     FromIP(net.IPv4(192, 168, 100, 2)),
+		VtepIP:       FromIP(net.IPv4(192, 168, 100, 2)),
+		Subnet:       testPeerSn,
+		HardwareAddr: net.HardwareAddr{0x0e, 0, 0, 0, 0, 2},
+	}
+)
+
+// newTestDevice returns a device in mode programmed through a fake handle,
+// leasing 10.5.1.0/24 on 192.168.100.1.
+func newTestDevice(t *testing.T, mode string) (*vxlanDevice, *fakeNetlink) {
+	f := newFakeNetlink()
+	dev, err := newVxlanDevice(f, &vxlanDeviceAttrs{
+		vni:      1,
+		name:     "vxlan.1",
+		vtepAddr: net.IPv4(192, 168, 100, 1).To4(),
+		mode:     mode,
+		overlay:  &net.IPNet{IP: net.IPv4(10, 5, 0, 0).To4(), Mask: net.CIDRMask(16, 32)},
+		publicIP: FromIP(net.IPv4(192, 168, 100, 1)),
+		localNet: &net.IPNet{IP: net.IPv4(192, 168, 100, 0).To4(), Mask: net.CIDRMask(24, 32)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.network = "test"
+	dev.lease = IP4Net{IP: FromIP(net.IPv4(10, 5, 1, 0)), PrefixLen: 24}
+	f.reset()
+	return dev, f
+}
+
+func assertCalls(t *testing.T, f *fakeNetlink, want ...string) {
+	t.Helper()
+	if !reflect.DeepEqual(f.calls, want) {
+		t.Fatalf("calls:\n got %q\nwant %q", f.calls, want)
+	}
+}
+
+func assertEmpty(t *testing.T, f *fakeNetlink) {
+	t.Helper()
+	if len(f.neighs) > 0 || len(f.routes) > 0 || len(f.states) > 0 || len(f.policies) > 0 {
+		t.Fatalf("entries left behind: neighs %v routes %v states %v policies %v", f.neighs, f.routes, f.states, f.policies)
+	}
+}
+
+func TestAddPeer(t *testing.T) {
+	dev, f := newTestDevice(t, modeUnicast)
+
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: testPeer}}, false)
+
+	assertCalls(t, f,
+		"NeighSet arp 10.5.2.0",
+		"NeighSet fdb 192.168.100.2",
+		"RouteReplace 10.5.2.0/24",
+	)
+	p := dev.peers[testPeerSn]
+	if p == nil || !p.arp || !p.fdb || !p.route || p.lastErr != nil {
+		t.Fatalf("peer not fully programmed: %+v", p)
+	}
+	if !dev.programmed(p) {
+		t.Fatal("programmed reports false for a fully programmed peer")
+	}
+}
+
+func TestAddPeerFDBFailure(t *testing.T) {
+	dev, f := newTestDevice(t, modeUnicast)
+	f.fail["NeighSet fdb"] = errors.New("no buffer space")
+
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: testPeer}}, false)
+
+	// the ARP entry is rolled back and no route points at the peer
+	assertCalls(t, f,
+		"NeighSet arp 10.5.2.0",
+		"NeighSet fdb 192.168.100.2",
+		"NeighDel arp 10.5.2.0",
+	)
+	assertEmpty(t, f)
+	p := dev.peers[testPeerSn]
+	if p == nil || p.arp || p.fdb || p.route || p.lastErr == nil {
+		t.Fatalf("unexpected peer state: %+v", p)
+	}
+	if dev.programmed(p) {
+		t.Fatal("programmed reports true for a failed peer")
+	}
+}
+
+func TestAddPeerRouteFailure(t *testing.T) {
+	dev, f := newTestDevice(t, modeUnicast)
+	f.fail["RouteReplace"] = errors.New("network is unreachable")
+
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: testPeer}}, false)
+
+	assertCalls(t, f,
+		"NeighSet arp 10.5.2.0",
+		"NeighSet fdb 192.168.100.2",
+		"RouteReplace 10.5.2.0/24",
+		"NeighDel arp 10.5.2.0",
+		"NeighDel fdb 192.168.100.2",
+	)
+	assertEmpty(t, f)
+	if p := dev.peers[testPeerSn]; p.arp || p.fdb || p.route || p.lastErr == nil {
+		t.Fatalf("unexpected peer state: %+v", p)
+	}
+
+	// the next event for the peer programs it once the kernel cooperates
+	delete(f.fail, "RouteReplace")
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: testPeer}}, false)
+	if p := dev.peers[testPeerSn]; !dev.programmed(p) || p.lastErr != nil {
+		t.Fatalf("peer not programmed on retry: %+v", p)
+	}
+}
+
+func TestRemovePeer(t *testing.T) {
+	dev, f := newTestDevice(t, modeUnicast)
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: testPeer}}, false)
+	f.reset()
+
+	dev.handleSubnetEvents([]Event{{Type: eventRemove, Subnet: testPeerSn}}, false)
+
+	assertCalls(t, f,
+		"RouteDel 10.5.2.0/24",
+		"NeighDel arp 10.5.2.0",
+		"NeighDel fdb 192.168.100.2",
+	)
+	assertEmpty(t, f)
+	if len(dev.peers) != 0 {
+		t.Fatalf("peer still known: %v", dev.peers)
+	}
+
+	// removing an unknown peer is a no-op
+	f.reset()
+	dev.handleSubnetEvents([]Event{{Type: eventRemove, Subnet: testPeerSn}}, false)
+	assertCalls(t, f)
+}
+
+func TestRemovePeerPartiallyProgrammed(t *testing.T) {
+	dev, f := newTestDevice(t, modeUnicast)
+	f.fail["NeighSet fdb"] = errors.New("no buffer space")
+	f.fail["NeighDel arp"] = errors.New("no buffer space")
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: testPeer}}, false)
+
+	// the ARP entry the rollback failed to delete is retried on removal
+	delete(f.fail, "NeighDel arp")
+	f.reset()
+	dev.handleSubnetEvents([]Event{{Type: eventRemove, Subnet: testPeerSn}}, false)
+
+	assertCalls(t, f, "NeighDel arp 10.5.2.0")
+	assertEmpty(t, f)
+}
+
+func TestAddPeerMoved(t *testing.T) {
+	dev, f := newTestDevice(t, modeUnicast)
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: testPeer}}, false)
+	f.reset()
+
+	moved := testPeer
+	moved.PublicIP = FromIP(net.IPv4(192, 168, 100, 3))
+	moved.VtepIP = moved.PublicIP
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: moved}}, false)
+
+	assertCalls(t, f,
+		"RouteDel 10.5.2.0/24",
+		"NeighDel arp 10.5.2.0",
+		"NeighDel fdb 192.168.100.2",
+		"NeighSet arp 10.5.2.0",
+		"NeighSet fdb 192.168.100.3",
+		"RouteReplace 10.5.2.0/24",
+	)
+
+	// an unchanged peer is reprogrammed in place
+	f.reset()
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: moved}}, false)
+	assertCalls(t, f,
+		"NeighSet arp 10.5.2.0",
+		"NeighSet fdb 192.168.100.3",
+		"RouteReplace 10.5.2.0/24",
+	)
+}
+
+func TestAddPeerFlood(t *testing.T) {
+	dev, f := newTestDevice(t, modeFlood)
+
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: testPeer}}, false)
+	assertCalls(t, f,
+		"NeighAppend flood 192.168.100.2",
+		"RouteReplace 10.5.2.0/24",
+	)
+
+	f.reset()
+	dev.handleSubnetEvents([]Event{{Type: eventRemove, Subnet: testPeerSn}}, false)
+	assertCalls(t, f,
+		"RouteDel 10.5.2.0/24",
+		"NeighDel flood 192.168.100.2",
+	)
+	assertEmpty(t, f)
+}
+
+func TestAddPeerPortMismatch(t *testing.T) {
+	dev, f := newTestDevice(t, modeUnicast)
+
+	other := testPeer
+	other.Port = 4789
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: other}}, false)
+
+	assertCalls(t, f)
+	if p := dev.peers[testPeerSn]; p.lastErr == nil || dev.programmed(p) {
+		t.Fatalf("unexpected peer state: %+v", p)
+	}
+}
+
+func TestAddPeerIPsecFailure(t *testing.T) {
+	dev, f := newTestDevice(t, modeUnicast)
+	dev.attrs.ipsecSecret = make([]byte, ipsecSecretLen)
+	dev.attrs.ipsecNonce = []byte{1}
+	peer := testPeer
+	peer.IPsecNonce = []byte{2}
+	f.fail["XfrmPolicyAdd"] = errors.New("no buffer space")
+
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: peer}}, false)
+
+	// nothing may be sent to the peer without its SAs and policies
+	assertEmpty(t, f)
+	if p := dev.peers[testPeerSn]; p.ipsec || p.arp || p.route || p.lastErr == nil {
+		t.Fatalf("unexpected peer state: %+v", p)
+	}
+
+	delete(f.fail, "XfrmPolicyAdd")
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: peer}}, false)
+	if len(f.states) != 2 || len(f.policies) != 2 {
+		t.Fatalf("got %v SAs and %v policies, want 2 of each", len(f.states), len(f.policies))
+	}
+
+	dev.handleSubnetEvents([]Event{{Type: eventRemove, Subnet: testPeerSn}}, false)
+	assertEmpty(t, f)
+}
+
+func TestEnsureLinkUpdatesInPlace(t *testing.T) {
+	f := newFakeNetlink()
+	want := &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: "vxlan.1"}, VxlanId: 1, Port: 4789, Proxy: true}
+	created, err := ensureLink(f, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.reset()
+
+	// only the changed attributes are sent, never the port or flags the
+	// kernel refuses on change
+	want = &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: "vxlan.1", MTU: 1400}, VxlanId: 1, Port: 4789, Proxy: true, TTL: 64, Learning: true}
+	updated, err := ensureLink(f, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, f, "LinkAdd vxlan.1", "LinkSetMTU vxlan.1 1400", "VxlanChange vxlan.1")
+	if updated.Index != created.Index || updated.MTU != 1400 || updated.TTL != 64 || !updated.Learning || updated.Port != 4789 {
+		t.Fatalf("unexpected device %+v", updated)
+	}
+
+	// an MTU change alone doesn't touch the vxlan attributes
+	f.reset()
+	want.MTU = 1450
+	if _, err := ensureLink(f, want); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, f, "LinkAdd vxlan.1", "LinkSetMTU vxlan.1 1450")
+}
+
+func TestEnsureLinkRecreatesWhenUpdateFails(t *testing.T) {
+	f := newFakeNetlink()
+	if _, err := ensureLink(f, &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: "vxlan.1"}, VxlanId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	f.reset()
+	f.fail["VxlanChange"] = syscall.EOPNOTSUPP
+
+	link, err := ensureLink(f, &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: "vxlan.1"}, VxlanId: 1, TTL: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, f, "LinkAdd vxlan.1", "VxlanChange vxlan.1", "LinkDel vxlan.1", "LinkAdd vxlan.1")
+	if link.TTL != 64 {
+		t.Fatalf("recreated device has TTL %v, want 64", link.TTL)
+	}
+}
+
+func TestEnsureLinkRecreatesIncompatible(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		existing, want int
+		recreate       bool
+	}{
+		{"other port", 8472, 4789, true},
+		{"default port dropped", 4789, 0, true},
+		{"default port set", 0, 8472, false},
+		{"default port kept", 8472, 0, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := newFakeNetlink()
+			if _, err := ensureLink(f, &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: "vxlan.1"}, VxlanId: 1, Port: c.existing}); err != nil {
+				t.Fatal(err)
+			}
+			f.reset()
+
+			link, err := ensureLink(f, &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: "vxlan.1"}, VxlanId: 1, Port: c.want})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !c.recreate {
+				assertCalls(t, f, "LinkAdd vxlan.1")
+				return
+			}
+			assertCalls(t, f, "LinkAdd vxlan.1", "LinkDel vxlan.1", "LinkAdd vxlan.1")
+			if link.Port != c.want {
+				t.Fatalf("recreated device has port %v, want %v", link.Port, c.want)
+			}
+		})
+	}
+}
+
+func TestHandleSubnetEventsSnapshot(t *testing.T) {
+	dev, f := newTestDevice(t, modeUnicast)
+	other := IP4Net{IP: FromIP(net.IPv4(10, 5, 3, 0)), PrefixLen: 24}
+	otherAttrs := testPeer
+	otherAttrs.PublicIP = FromIP(net.IPv4(192, 168, 100, 3))
+	otherAttrs.VtepIP = otherAttrs.PublicIP
+	otherAttrs.HardwareAddr = net.HardwareAddr{0x0e, 0, 0, 0, 0, 3}
+	otherAttrs.Subnet = other
+
+	dev.handleSubnetEvents([]Event{
+		{Type: eventAdd, Subnet: testPeerSn, Attrs: testPeer},
+		{Type: eventAdd, Subnet: other, Attrs: otherAttrs},
+	}, true)
+	if len(dev.peers) != 2 {
+		t.Fatalf("got %v peers, want 2", len(dev.peers))
+	}
+
+	// a later snapshot without the peer removes it
+	f.reset()
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: other, Attrs: otherAttrs}}, true)
+	if _, ok := dev.peers[testPeerSn]; ok || len(dev.peers) != 1 {
+		t.Fatalf("unexpected peers %v", dev.peers)
+	}
+	if _, ok := f.routes["10.5.2.0/24"]; ok {
+		t.Fatal("route to the removed peer left behind")
+	}
+
+	// an empty snapshot removes everyone
+	dev.handleSubnetEvents(nil, true)
+	assertEmpty(t, f)
+	if len(dev.peers) != 0 {
+		t.Fatalf("unexpected peers %v", dev.peers)
+	}
+}
+
+func TestCheckReadyNeedsMissSubscription(t *testing.T) {
+	dev, _ := newTestDevice(t, modeMiss)
+	if err := dev.configure("10.5.1.0/32"); err != nil {
+		t.Fatal(err)
+	}
+	dev.handleSubnetEvents(nil, true)
+
+	if err := dev.checkReady(); err == nil {
+		t.Fatal("ready without a miss subscription")
+	}
+	dev.setMissesWatched(true)
+	if err := dev.checkReady(); err != nil {
+		t.Fatalf("not ready: %v", err)
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/coreos/etcd/client"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// endpoint is a workload attached to the bridge of a node in bridge mode.
+// Subnet is the lease of the node the workload currently lives on.
+type endpoint struct {
+	MAC    net.HardwareAddr
+	IP     IP4
+	Subnet IP4Net
+}
+
+type endpointEvent struct {
+	Type     string
+	MAC      net.HardwareAddr
+	Endpoint endpoint
+}
+
+// remoteEndpoint records what has been programmed for a workload of a peer.
+type remoteEndpoint struct {
+	ep     endpoint
+	vtepIP net.IP
+	arp    bool
+	fdb    bool
+}
+
+func makeEndpointKey(mac net.HardwareAddr) string {
+	return strings.Replace(mac.String(), ":", "-", -1)
+}
+
+func (m *manager) endpointKey(mac net.HardwareAddr) string {
+	return path.Join(m.Prefix, "endpoints", makeEndpointKey(mac))
+}
+
+func nodeToEndpoint(node *client.Node) (*endpoint, error) {
+	mac, err := net.ParseMAC(path.Base(node.Key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse endpoint key %s", node.Key)
+	}
+
+	ep := &endpoint{}
+	if err := json.Unmarshal([]byte(node.Value), ep); err != nil {
+		return nil, err
+	}
+	ep.MAC = mac
+
+	return ep, nil
+}
+
+func (m *manager) getEndpoints(ctx context.Context) ([]endpointEvent, *uint64, error) {
+	key := path.Join(m.Prefix, "endpoints")
+	resp, err := m.cli.Get(ctx, key, &client.GetOptions{Recursive: true, Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeKeyNotFound {
+			// watch from the current index rather than fetching again
+			return []endpointEvent{}, &etcdErr.Index, nil
+		}
+		return nil, nil, err
+	}
+
+	evts := []endpointEvent{}
+	for _, node := range resp.Node.Nodes {
+		ep, err := nodeToEndpoint(node)
+		if err != nil {
+			logrus.Warningf("Ignoring bad endpoint node: %v", err)
+			continue
+		}
+
+		evts = append(evts, endpointEvent{Type: eventAdd, MAC: ep.MAC, Endpoint: *ep})
+	}
+
+	return evts, &resp.Index, nil
+}
+
+func (m *manager) watchEndpointEvents(ctx context.Context, index *uint64) ([]endpointEvent, *uint64, error) {
+	if index == nil {
+		return m.getEndpoints(ctx)
+	}
+
+	opts := &client.WatcherOptions{
+		AfterIndex: *index,
+		Recursive:  true,
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, watchTimeoutSeconds*time.Second)
+	defer cancel()
+
+	resp, err := m.cli.Watcher(path.Join(m.Prefix, "endpoints"), opts).Next(wctx)
+	if err == context.DeadlineExceeded {
+		// nothing happened within watchTimeoutSeconds, keep watching from the same index
+		return []endpointEvent{}, index, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idx := resp.Node.ModifiedIndex
+	mac, err := net.ParseMAC(path.Base(resp.Node.Key))
+	if err != nil {
+		logrus.Warningf("%v %q: not an endpoint, skipping", resp.Action, resp.Node.Key)
+		return []endpointEvent{}, &idx, nil
+	}
+
+	switch resp.Action {
+	case "delete", "compareAndDelete", "expire":
+		return []endpointEvent{{Type: eventRemove, MAC: mac}}, &idx, nil
+	default:
+		ep, err := nodeToEndpoint(resp.Node)
+		if err != nil {
+			logrus.Warningf("Ignoring bad endpoint node: %v", err)
+			return []endpointEvent{}, &idx, nil
+		}
+		return []endpointEvent{{Type: eventAdd, MAC: mac, Endpoint: *ep}}, &idx, nil
+	}
+}
+
+// publishEndpoint announces ep under its MAC for endpointTTL. A workload
+// that migrated here simply takes the key over from its previous node.
+func (m *manager) publishEndpoint(ctx context.Context, ep endpoint) error {
+	value, err := json.Marshal(ep)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.cli.Set(ctx, m.endpointKey(ep.MAC), string(value), &client.SetOptions{TTL: endpointTTL})
+	return err
+}
+
+// refreshEndpoint extends the TTL of ep if the registry still holds it as we
+// published it, without notifying watchers. It republishes ep if its key
+// expired and returns false if another node has taken the key over.
+func (m *manager) refreshEndpoint(ctx context.Context, ep endpoint) (bool, error) {
+	value, err := json.Marshal(ep)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = m.cli.Set(ctx, m.endpointKey(ep.MAC), "", &client.SetOptions{
+		PrevValue: string(value),
+		TTL:       endpointTTL,
+		Refresh:   true,
+	})
+	if etcdErr, ok := err.(client.Error); ok {
+		switch etcdErr.Code {
+		case client.ErrorCodeKeyNotFound:
+			return true, m.publishEndpoint(ctx, ep)
+		case client.ErrorCodeTestFailed:
+			return false, nil
+		}
+	}
+	return err == nil, err
+}
+
+// withdrawEndpoint deletes the endpoint of mac if it is still owned by sn, so
+// that a node doesn't withdraw a workload that migrated away from it.
+func (m *manager) withdrawEndpoint(ctx context.Context, mac net.HardwareAddr, sn IP4Net) error {
+	key := m.endpointKey(mac)
+	resp, err := m.cli.Get(ctx, key, &client.GetOptions{Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeKeyNotFound {
+			return nil
+		}
+		return err
+	}
+
+	ep, err := nodeToEndpoint(resp.Node)
+	if err != nil {
+		return err
+	}
+	if ep.Subnet != sn {
+		return nil
+	}
+
+	_, err = m.cli.Delete(ctx, key, &client.DeleteOptions{PrevIndex: resp.Node.ModifiedIndex})
+	if etcdErr, ok := err.(client.Error); ok && (etcdErr.Code == client.ErrorCodeKeyNotFound || etcdErr.Code == client.ErrorCodeTestFailed) {
+		return nil
+	}
+	return err
+}
+
+// handleEndpoints programs the workloads published by other nodes onto the
+// device.
+func handleEndpoints(ctx context.Context, sn IP4Net, sm *manager, dev *vxlanDevice) {
+	var index *uint64
+	for {
+		snapshot := index == nil
+		evts, idx, err := sm.watchEndpointEvents(ctx, index)
+		if err != nil {
+			logrus.Errorf("Watch endpoints: %v", err)
+			etcdWatchErrorsCounter.WithLabelValues(sm.network).Inc()
+			// events may have been lost, start over from a snapshot
+			index = nil
+			time.Sleep(time.Second)
+			continue
+		}
+		index = idx
+
+		batch := []endpointEvent{}
+		for _, e := range evts {
+			if e.Type == eventAdd && e.Endpoint.Subnet == sn {
+				// the workload is ours, possibly after migrating here: drop
+				// what we programmed for its previous node
+				e = endpointEvent{Type: eventRemove, MAC: e.MAC}
+			}
+			batch = append(batch, e)
+		}
+
+		if len(batch) > 0 || snapshot {
+			dev.handleEndpointEvents(batch, snapshot)
+		}
+	}
+}
+
+// handleEndpointEvents applies a batch of endpoint events. A snapshot
+// replaces all known endpoints.
+func (dev *vxlanDevice) handleEndpointEvents(batch []endpointEvent, snapshot bool) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	defer dev.updatePeerMetrics()
+
+	if snapshot {
+		seen := map[string]bool{}
+		for _, e := range batch {
+			seen[e.MAC.String()] = true
+		}
+		for mac, re := range dev.endpoints {
+			if !seen[mac] {
+				dev.removeEndpoint(re.ep.MAC)
+			}
+		}
+	}
+
+	for _, e := range batch {
+		switch e.Type {
+		case eventAdd:
+			dev.addEndpoint(e.Endpoint)
+		case eventRemove:
+			dev.removeEndpoint(e.MAC)
+		}
+	}
+}
+
+// removeLease removes the peer sn along with its workloads, which died or
+// moved with the node that held sn. The caller must hold dev.mu.
+func (dev *vxlanDevice) removeLease(sn IP4Net) {
+	dev.removePeer(sn)
+	for _, re := range dev.endpoints {
+		if re.ep.Subnet == sn {
+			dev.removeEndpoint(re.ep.MAC)
+		}
+	}
+}
+
+// addEndpoint records ep and programs it if its node is a known peer. The
+// caller must hold dev.mu.
+func (dev *vxlanDevice) addEndpoint(ep endpoint) {
+	if old, ok := dev.endpoints[ep.MAC.String()]; ok {
+		if bytes.Equal(old.ep.MAC, ep.MAC) && old.ep.IP == ep.IP && old.ep.Subnet == ep.Subnet {
+			return
+		}
+		// the workload moved or changed its address
+		dev.removeEndpoint(ep.MAC)
+	}
+
+	re := &remoteEndpoint{ep: ep}
+	dev.endpoints[ep.MAC.String()] = re
+	if p, ok := dev.peers[ep.Subnet]; ok {
+		dev.programEndpoint(re, p)
+	}
+}
+
+// removeEndpoint forgets the endpoint of mac. The caller must hold dev.mu.
+func (dev *vxlanDevice) removeEndpoint(mac net.HardwareAddr) {
+	re, ok := dev.endpoints[mac.String()]
+	if !ok {
+		return
+	}
+	delete(dev.endpoints, mac.String())
+	dev.unprogramEndpoint(re)
+}
+
+// programEndpoint points the workload's MAC at the VTEP of p and installs
+// its ARP entry, which the device answers local requests from.
+func (dev *vxlanDevice) programEndpoint(re *remoteEndpoint, p *peer) {
+	re.vtepIP = dev.peerVtepIP(p.attrs)
+	logrus.Infof("adding endpoint: %s IP: %s VtepIP: %s", re.ep.MAC, re.ep.IP.ToIP(), re.vtepIP)
+
+	err := dev.AddFDB(neighbor{IP: re.vtepIP, MAC: re.ep.MAC})
+	observeOp(dev.network, "AddEndpointFDB", err)
+	if err != nil {
+		logrus.Error("AddFDB failed: ", err)
+		return
+	}
+	re.fdb = true
+
+	err = dev.AddARP(neighbor{IP: re.ep.IP.ToIP(), MAC: re.ep.MAC})
+	observeOp(dev.network, "AddEndpointARP", err)
+	if err != nil {
+		logrus.Error("AddARP failed: ", err)
+		return
+	}
+	re.arp = true
+}
+
+func (dev *vxlanDevice) unprogramEndpoint(re *remoteEndpoint) {
+	if re.arp {
+		if err := dev.DelARP(neighbor{IP: re.ep.IP.ToIP(), MAC: re.ep.MAC}); err != nil {
+			logrus.Error("DelARP failed: ", err)
+		} else {
+			re.arp = false
+		}
+	}
+
+	if re.fdb {
+		if err := dev.DelFDB(neighbor{IP: re.vtepIP, MAC: re.ep.MAC}); err != nil {
+			logrus.Error("DelFDB failed: ", err)
+		} else {
+			re.fdb = false
+		}
+	}
+}
+
+// peerEndpoints calls fn for every endpoint living on the peer sn.
+func (dev *vxlanDevice) peerEndpoints(sn IP4Net, fn func(re *remoteEndpoint)) {
+	for _, re := range dev.endpoints {
+		if re.ep.Subnet == sn {
+			fn(re)
+		}
+	}
+}
+
+// localEndpoints tracks the workloads attached to our bridge: their MACs from
+// the bridge FDB and their addresses from the bridge's ARP table.
+type localEndpoints struct {
+	ports     map[string]bool
+	addrs     map[string]IP4
+	published map[string]IP4
+}
+
+// advertiseEndpoints publishes the workloads attached to the bridge of the
+// network and withdraws them when they leave.
+func (n *network) advertiseEndpoints(ctx context.Context, ns netns.NsHandle) {
+	local := &localEndpoints{published: map[string]IP4{}}
+
+	refresh := time.NewTicker(endpointTTL / 4)
+	defer refresh.Stop()
+
+	resubscribe(ctx, fmt.Sprintf("[%s] Advertising endpoints", n.cfg.Name), func(bool) error {
+		done := make(chan struct{})
+		var ch chan netlink.NeighUpdate
+		defer func() {
+			close(done)
+			// let the subscription goroutine exit if it is blocked on a send
+			if ch != nil {
+				go func() {
+					for range ch {
+					}
+				}()
+			}
+		}()
+
+		var neighErr error
+		nch := make(chan netlink.NeighUpdate)
+		if err := netlink.NeighSubscribeWithOptions(nch, done, netlink.NeighSubscribeOptions{
+			Namespace:     &ns,
+			ErrorCallback: func(err error) { neighErr = err },
+		}); err != nil {
+			return fmt.Errorf("failed to subscribe to neighbor updates: %v", err)
+		}
+		ch = nch
+
+		// updates may have been missed while unsubscribed, start over from
+		// the current bridge tables
+		local.ports = map[string]bool{}
+		local.addrs = map[string]IP4{}
+		if err := n.syncEndpoints(ctx, local); err != nil {
+			logrus.Errorf("[%s] Failed to sync local endpoints: %v", n.cfg.Name, err)
+		}
+
+		for {
+			var u netlink.NeighUpdate
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-refresh.C:
+				n.refreshEndpoints(ctx, local)
+				continue
+			case u, ok = <-ch:
+				if !ok {
+					ch = nil
+					return fmt.Errorf("neighbor update subscription closed: %v", neighErr)
+				}
+			}
+
+			if u.Type != syscall.RTM_NEWNEIGH && u.Type != syscall.RTM_DELNEIGH {
+				continue
+			}
+			if mac := local.update(n.dev, u.Neigh, u.Type == syscall.RTM_NEWNEIGH); mac != nil {
+				n.reconcileEndpoint(ctx, local, mac)
+			}
+		}
+	})
+}
+
+// refreshEndpoints keeps the endpoints we published from expiring. Those
+// another node has taken over are no longer ours to refresh or withdraw.
+func (n *network) refreshEndpoints(ctx context.Context, local *localEndpoints) {
+	for key, ip := range local.published {
+		mac, _ := net.ParseMAC(key)
+		owned, err := n.sm.refreshEndpoint(ctx, endpoint{MAC: mac, IP: ip, Subnet: n.lease})
+		observeOp(n.cfg.Name, "RefreshEndpoint", err)
+		if err != nil {
+			logrus.Errorf("[%s] Failed to refresh endpoint %s: %v", n.cfg.Name, mac, err)
+			continue
+		}
+		if !owned {
+			logrus.Infof("[%s] endpoint %s was taken over by another node", n.cfg.Name, mac)
+			delete(local.published, key)
+		}
+	}
+}
+
+// syncEndpoints loads the current bridge tables and withdraws endpoints we
+// published before a restart, or before the subscription was lost, that are
+// gone now.
+func (n *network) syncEndpoints(ctx context.Context, local *localEndpoints) error {
+	br := n.dev.bridgeLink()
+	fdb, err := n.dev.nlh.NeighList(0, syscall.AF_BRIDGE)
+	if err != nil {
+		return err
+	}
+	arp, err := n.dev.nlh.NeighList(br.Index, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+
+	for _, neigh := range append(fdb, arp...) {
+		if mac := local.update(n.dev, neigh, true); mac != nil {
+			n.reconcileEndpoint(ctx, local, mac)
+		}
+	}
+	for key := range local.published {
+		mac, _ := net.ParseMAC(key)
+		n.reconcileEndpoint(ctx, local, mac)
+	}
+
+	evts, _, err := n.sm.getEndpoints(ctx)
+	if err != nil {
+		return err
+	}
+	for _, e := range evts {
+		if e.Endpoint.Subnet != n.lease {
+			continue
+		}
+		if _, ok := local.published[e.MAC.String()]; !ok {
+			logrus.Infof("[%s] withdrawing stale endpoint %s", n.cfg.Name, e.MAC)
+			if err := n.sm.withdrawEndpoint(ctx, e.MAC, n.lease); err != nil {
+				logrus.Errorf("[%s] Failed to withdraw endpoint %s: %v", n.cfg.Name, e.MAC, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// update applies a neighbor entry to the local tables and returns the MAC of
+// the workload it concerns, nil if it isn't about a local workload.
+func (l *localEndpoints) update(dev *vxlanDevice, neigh netlink.Neigh, add bool) net.HardwareAddr {
+	br := dev.bridgeLink()
+	if br == nil || len(neigh.HardwareAddr) == 0 {
+		return nil
+	}
+	mac := neigh.HardwareAddr.String()
+
+	switch {
+	case neigh.Family == syscall.AF_BRIDGE && neigh.MasterIndex == br.Index:
+		// permanent entries are the bridge's and its ports' own addresses,
+		// entries on the vxlan port are remote workloads
+		if neigh.State&netlink.NUD_PERMANENT != 0 || neigh.LinkIndex == dev.vxlanLink().Index {
+			if !l.ports[mac] {
+				return nil
+			}
+			add = false
+		}
+		if add {
+			l.ports[mac] = true
+		} else {
+			delete(l.ports, mac)
+		}
+
+	case neigh.Family == netlink.FAMILY_V4 && neigh.LinkIndex == br.Index:
+		if bytes.Equal(neigh.HardwareAddr, br.HardwareAddr) {
+			return nil
+		}
+		if add && neigh.State&(netlink.NUD_FAILED|netlink.NUD_INCOMPLETE) == 0 {
+			l.addrs[mac] = FromIP(neigh.IP)
+		} else if l.addrs[mac] == FromIP(neigh.IP) {
+			delete(l.addrs, mac)
+		}
+
+	default:
+		return nil
+	}
+
+	return neigh.HardwareAddr
+}
+
+// reconcileEndpoint publishes or withdraws the workload mac so that the
+// registry matches the local tables.
+func (n *network) reconcileEndpoint(ctx context.Context, local *localEndpoints, mac net.HardwareAddr) {
+	key := mac.String()
+	ip, hasAddr := local.addrs[key]
+	published, isPublished := local.published[key]
+
+	if local.ports[key] && hasAddr {
+		if isPublished && published == ip {
+			return
+		}
+		ep := endpoint{MAC: mac, IP: ip, Subnet: n.lease}
+		err := n.sm.publishEndpoint(ctx, ep)
+		observeOp(n.cfg.Name, "PublishEndpoint", err)
+		if err != nil {
+			logrus.Errorf("[%s] Failed to publish endpoint %s: %v", n.cfg.Name, mac, err)
+			return
+		}
+		logrus.Infof("[%s] published endpoint %s IP: %s", n.cfg.Name, mac, ip.ToIP())
+		local.published[key] = ip
+		return
+	}
+
+	if !isPublished {
+		return
+	}
+	err := n.sm.withdrawEndpoint(ctx, mac, n.lease)
+	observeOp(n.cfg.Name, "WithdrawEndpoint", err)
+	if err != nil {
+		logrus.Errorf("[%s] Failed to withdraw endpoint %s: %v", n.cfg.Name, mac, err)
+		return
+	}
+	logrus.Infof("[%s] withdrew endpoint %s", n.cfg.Name, mac)
+	delete(local.published, key)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+var testEndpoint = endpoint{
+	MAC:    net.HardwareAddr{0x52, 0x54, 0x00, 0x00, 0x00, 0x01},
+	IP:     FromIP(net.IPv4(10, 5, 2, 10)),
+	Subnet: testPeerSn,
+}
+
+func TestRefreshEndpoint(t *testing.T) {
+	ctx := context.Background()
+	sm, reg := newTestManager()
+	key := sm.endpointKey(testEndpoint.MAC)
+
+	if err := sm.publishEndpoint(ctx, testEndpoint); err != nil {
+		t.Fatal(err)
+	}
+	if n := reg.nodes[key]; n == nil || n.Expiration == nil {
+		t.Fatalf("endpoint published without a TTL: %+v", n)
+	}
+
+	events := len(reg.history)
+	if owned, err := sm.refreshEndpoint(ctx, testEndpoint); !owned || err != nil {
+		t.Fatalf("got %v, %v; want true, nil", owned, err)
+	}
+	if len(reg.history) != events {
+		t.Fatal("refresh was seen by watchers")
+	}
+
+	// the key of a node that was partitioned for too long is republished
+	reg.expire(key)
+	if owned, err := sm.refreshEndpoint(ctx, testEndpoint); !owned || err != nil {
+		t.Fatalf("got %v, %v; want true, nil", owned, err)
+	}
+	if reg.nodes[key] == nil {
+		t.Fatal("expired endpoint not republished")
+	}
+
+	// the workload migrated to another node
+	moved := testEndpoint
+	moved.Subnet = testSubnet("10.5.3.0/24")
+	if err := sm.publishEndpoint(ctx, moved); err != nil {
+		t.Fatal(err)
+	}
+	if owned, err := sm.refreshEndpoint(ctx, testEndpoint); owned || err != nil {
+		t.Fatalf("got %v, %v; want false, nil", owned, err)
+	}
+	if ep, _ := nodeToEndpoint(reg.nodes[key]); ep == nil || ep.Subnet != moved.Subnet {
+		t.Fatalf("refresh overwrote the migrated endpoint: %+v", ep)
+	}
+}
+
+func TestWatchEndpointWithdrawn(t *testing.T) {
+	ctx := context.Background()
+	sm, _ := newTestManager()
+
+	if err := sm.publishEndpoint(ctx, testEndpoint); err != nil {
+		t.Fatal(err)
+	}
+	evts, index, err := sm.watchEndpointEvents(ctx, nil)
+	if err != nil || len(evts) != 1 || evts[0].Type != eventAdd {
+		t.Fatalf("got %+v, %v; want one add", evts, err)
+	}
+
+	if err := sm.withdrawEndpoint(ctx, testEndpoint.MAC, testEndpoint.Subnet); err != nil {
+		t.Fatal(err)
+	}
+	evts, _, err = sm.watchEndpointEvents(ctx, index)
+	if err != nil || len(evts) != 1 || evts[0].Type != eventRemove || evts[0].MAC.String() != testEndpoint.MAC.String() {
+		t.Fatalf("got %+v, %v; want the removal of %s", evts, err, testEndpoint.MAC)
+	}
+}
+
+func TestRemoveLeaseDropsEndpoints(t *testing.T) {
+	dev, f := newTestDevice(t, modeBridge)
+
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: testPeer}}, false)
+	dev.handleEndpointEvents([]endpointEvent{{Type: eventAdd, MAC: testEndpoint.MAC, Endpoint: testEndpoint}}, false)
+	if re := dev.endpoints[testEndpoint.MAC.String()]; re == nil || !re.arp || !re.fdb {
+		t.Fatalf("endpoint not programmed: %+v", re)
+	}
+
+	// the node died and its lease expired along with the endpoints it could
+	// no longer refresh
+	dev.handleSubnetEvents([]Event{{Type: eventRemove, Subnet: testPeerSn}}, false)
+
+	if len(dev.endpoints) != 0 {
+		t.Fatalf("endpoints of the removed lease left: %v", dev.endpoints)
+	}
+	assertEmpty(t, f)
+
+	// nor does it come back with a node reusing the lease
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: testPeer}}, false)
+	for _, n := range f.neighs {
+		if n.HardwareAddr.String() == testEndpoint.MAC.String() {
+			t.Fatalf("endpoint of the old node programmed: %+v", n)
+		}
+	}
+}
+
+func TestGetEndpointsEmptyReturnsIndex(t *testing.T) {
+	ctx := context.Background()
+	sm, _ := newTestManager()
+	if err := sm.createSubnet(ctx, testPeerSn, testPeer, subnetTTL); err != nil {
+		t.Fatal(err)
+	}
+
+	// without an index the caller would fetch the snapshot again and again
+	if evts, index, err := sm.getEndpoints(ctx); err != nil || len(evts) != 0 || index == nil || *index == 0 {
+		t.Fatalf("got %v, %v, %v; want no endpoints and the current index", evts, index, err)
+	}
+}
+
+func TestHandleEndpoints(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sm, reg := newTestManager()
+	dev, _ := newTestDevice(t, modeBridge)
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: testPeer}}, false)
+	if err := sm.publishEndpoint(ctx, testEndpoint); err != nil {
+		t.Fatal(err)
+	}
+	go handleEndpoints(ctx, dev.lease, sm, dev)
+
+	waitEndpoints := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			dev.mu.Lock()
+			got := len(dev.endpoints)
+			dev.mu.Unlock()
+			if got == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got %v endpoints, want %v", got, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitEndpoints(1)
+
+	// the workload migrates here, what was programmed for the peer goes
+	moved := testEndpoint
+	moved.Subnet = dev.lease
+	if err := sm.publishEndpoint(ctx, moved); err != nil {
+		t.Fatal(err)
+	}
+	waitEndpoints(0)
+
+	if err := sm.publishEndpoint(ctx, testEndpoint); err != nil {
+		t.Fatal(err)
+	}
+	waitEndpoints(1)
+
+	// the withdrawal happens while the watch is broken and leaves the
+	// history before the watch is back
+	reg.failWatch(errors.New("etcd cluster is unavailable"))
+	if err := sm.withdrawEndpoint(ctx, testEndpoint.MAC, testEndpoint.Subnet); err != nil {
+		t.Fatal(err)
+	}
+	reg.compact()
+	waitEndpoints(0)
+}
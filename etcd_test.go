@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// fakeKeysAPI is an in-memory registry behaving like the parts of the etcd
+// v2 keys API we use. TTLs are recorded but keys only expire through expire.
+type fakeKeysAPI struct {
+	mu      sync.Mutex
+	index   uint64
+	nodes   map[string]*client.Node
+	history []*client.Response
+	// compacted is the last index dropped from history, see compact
+	compacted uint64
+	// watchErr is returned once by the next watcher call
+	watchErr error
+	// changed is closed and replaced whenever history grows
+	changed chan struct{}
+}
+
+func newFakeKeysAPI() *fakeKeysAPI {
+	return &fakeKeysAPI{
+		nodes:   map[string]*client.Node{},
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *fakeKeysAPI) errorf(code int, key string) error {
+	return client.Error{Code: code, Message: key, Index: f.index}
+}
+
+// record stores the change and wakes up watchers. f.mu must be held.
+func (f *fakeKeysAPI) record(action string, node, prev *client.Node) *client.Response {
+	resp := &client.Response{Action: action, Node: node, PrevNode: prev, Index: f.index}
+	f.history = append(f.history, resp)
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return resp
+}
+
+func (f *fakeKeysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if n, ok := f.nodes[key]; ok {
+		c := *n
+		return &client.Response{Action: "get", Node: &c, Index: f.index}, nil
+	}
+
+	// our keys are never more than one level below the directories we list
+	dir := &client.Node{Key: key, Dir: true}
+	for k, n := range f.nodes {
+		if strings.HasPrefix(k, key+"/") {
+			c := *n
+			dir.Nodes = append(dir.Nodes, &c)
+		}
+	}
+	if len(dir.Nodes) == 0 {
+		return nil, f.errorf(client.ErrorCodeKeyNotFound, key)
+	}
+	sort.Slice(dir.Nodes, func(i, j int) bool { return dir.Nodes[i].Key < dir.Nodes[j].Key })
+	return &client.Response{Action: "get", Node: dir, Index: f.index}, nil
+}
+
+func (f *fakeKeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if opts == nil {
+		opts = &client.SetOptions{}
+	}
+	prev, exists := f.nodes[key]
+
+	action := "set"
+	switch opts.PrevExist {
+	case client.PrevNoExist:
+		if exists {
+			return nil, f.errorf(client.ErrorCodeNodeExist, key)
+		}
+		action = "create"
+	case client.PrevExist:
+		if !exists {
+			return nil, f.errorf(client.ErrorCodeKeyNotFound, key)
+		}
+		action = "update"
+	}
+	if opts.PrevIndex != 0 || opts.PrevValue != "" {
+		if !exists {
+			return nil, f.errorf(client.ErrorCodeKeyNotFound, key)
+		}
+		if (opts.PrevIndex != 0 && prev.ModifiedIndex != opts.PrevIndex) ||
+			(opts.PrevValue != "" && prev.Value != opts.PrevValue) {
+			return nil, f.errorf(client.ErrorCodeTestFailed, key)
+		}
+		action = "compareAndSwap"
+	}
+
+	f.index++
+	node := &client.Node{Key: key, Value: value, CreatedIndex: f.index, ModifiedIndex: f.index}
+	if exists {
+		node.CreatedIndex = prev.CreatedIndex
+	}
+	if opts.TTL > 0 {
+		exp := time.Now().Add(opts.TTL)
+		node.Expiration = &exp
+		node.TTL = int64(opts.TTL / time.Second)
+	}
+
+	if opts.Refresh {
+		if !exists {
+			return nil, f.errorf(client.ErrorCodeKeyNotFound, key)
+		}
+		// a refresh only moves the expiration and is not seen by watchers
+		node.Value = prev.Value
+		f.nodes[key] = node
+		c := *node
+		return &client.Response{Action: "update", Node: &c, Index: f.index}, nil
+	}
+
+	f.nodes[key] = node
+	c := *node
+	f.record(action, node, prev)
+	return &client.Response{Action: action, Node: &c, PrevNode: prev, Index: f.index}, nil
+}
+
+func (f *fakeKeysAPI) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prev, exists := f.nodes[key]
+	if !exists {
+		return nil, f.errorf(client.ErrorCodeKeyNotFound, key)
+	}
+
+	action := "delete"
+	if opts != nil && (opts.PrevIndex != 0 || opts.PrevValue != "") {
+		if (opts.PrevIndex != 0 && prev.ModifiedIndex != opts.PrevIndex) ||
+			(opts.PrevValue != "" && prev.Value != opts.PrevValue) {
+			return nil, f.errorf(client.ErrorCodeTestFailed, key)
+		}
+		action = "compareAndDelete"
+	}
+
+	return f.remove(action, key, prev), nil
+}
+
+// failWatch makes the next watcher call fail with err.
+func (f *fakeKeysAPI) failWatch(err error) {
+	f.mu.Lock()
+	f.watchErr = err
+	f.mu.Unlock()
+}
+
+// compact drops the history like etcd does once it holds too many events,
+// watchers still behind it fail with ErrorCodeEventIndexCleared.
+func (f *fakeKeysAPI) compact() {
+	f.mu.Lock()
+	f.history = nil
+	f.compacted = f.index
+	f.mu.Unlock()
+}
+
+// expire removes key as if its TTL ran out.
+func (f *fakeKeysAPI) expire(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prev, exists := f.nodes[key]
+	if exists {
+		f.remove("expire", key, prev)
+	}
+	return exists
+}
+
+func (f *fakeKeysAPI) remove(action, key string, prev *client.Node) *client.Response {
+	f.index++
+	delete(f.nodes, key)
+	return f.record(action, &client.Node{Key: key, ModifiedIndex: f.index}, prev)
+}
+
+func (f *fakeKeysAPI) Create(ctx context.Context, key, value string) (*client.Response, error) {
+	return f.Set(ctx, key, value, &client.SetOptions{PrevExist: client.PrevNoExist})
+}
+
+func (f *fakeKeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *client.CreateInOrderOptions) (*client.Response, error) {
+	return nil, errors.New("CreateInOrder is not supported")
+}
+
+func (f *fakeKeysAPI) Update(ctx context.Context, key, value string) (*client.Response, error) {
+	return f.Set(ctx, key, value, &client.SetOptions{PrevExist: client.PrevExist})
+}
+
+func (f *fakeKeysAPI) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	w := &fakeWatcher{f: f, key: key}
+	if opts != nil {
+		w.after = opts.AfterIndex
+		w.recursive = opts.Recursive
+	}
+	return w
+}
+
+type fakeWatcher struct {
+	f         *fakeKeysAPI
+	key       string
+	after     uint64
+	recursive bool
+}
+
+func (w *fakeWatcher) Next(ctx context.Context) (*client.Response, error) {
+	for {
+		w.f.mu.Lock()
+		if err := w.f.watchErr; err != nil {
+			w.f.watchErr = nil
+			w.f.mu.Unlock()
+			return nil, err
+		}
+		if w.after < w.f.compacted {
+			err := w.f.errorf(client.ErrorCodeEventIndexCleared, w.key)
+			w.f.mu.Unlock()
+			return nil, err
+		}
+		changed := w.f.changed
+		for _, resp := range w.f.history {
+			if resp.Node.ModifiedIndex <= w.after {
+				continue
+			}
+			k := resp.Node.Key
+			if k == w.key || (w.recursive && strings.HasPrefix(k, w.key+"/")) {
+				w.after = resp.Node.ModifiedIndex
+				w.f.mu.Unlock()
+				return resp, nil
+			}
+		}
+		w.f.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	gbpAllow = "allow"
+	gbpDrop  = "drop"
+
+	// gbpMask selects the bits of the fwmark the vxlan driver carries as the
+	// group policy ID
+	gbpMask = 0xffff
+)
+
+// gbpConfig enables Group-Based Policy on a network. Traffic leaving our
+// lease is tagged with Group, or with the group of the workload it comes
+// from, and traffic arriving from peers is allowed or dropped by the group
+// it was tagged with.
+type gbpConfig struct {
+	Group         uint16        `json:"group"`
+	Workloads     []gbpWorkload `json:"workloads"`
+	Policy        []gbpRule     `json:"policy"`
+	DefaultAction string        `json:"defaultAction"`
+}
+
+type gbpWorkload struct {
+	CIDR  string `json:"cidr"`
+	Group uint16 `json:"group"`
+}
+
+type gbpRule struct {
+	Group  uint16 `json:"group"`
+	Action string `json:"action"`
+}
+
+func (g *gbpConfig) validate(network *net.IPNet) error {
+	for _, w := range g.Workloads {
+		ip, _, err := net.ParseCIDR(w.CIDR)
+		if err != nil {
+			return fmt.Errorf("gbp workload: %v", err)
+		}
+		if !network.Contains(ip) {
+			return fmt.Errorf("gbp workload %s is outside of %s", w.CIDR, network)
+		}
+	}
+
+	for _, r := range g.Policy {
+		if r.Action != gbpAllow && r.Action != gbpDrop {
+			return fmt.Errorf("gbp policy for group %v: unknown action %q", r.Group, r.Action)
+		}
+	}
+
+	switch g.DefaultAction {
+	case "":
+		g.DefaultAction = gbpAllow
+	case gbpAllow, gbpDrop:
+	default:
+		return fmt.Errorf("gbp: unknown default action %q", g.DefaultAction)
+	}
+
+	return nil
+}
+
+// gbpRules returns the rules tagging traffic from our lease and enforcing the
+// policy on traffic decapsulated by the device named dev. They must come
+// before the forward rules accepting the whole network. Bridged traffic only
+// traverses iptables with br_netfilter, and is matched on its bridge port.
+func gbpRules(g *gbpConfig, dev string, bridged bool, lease IP4Net) []IPTablesRule {
+	var rules []IPTablesRule
+
+	from := []string{"-i", dev}
+	notFrom := []string{"!", "-i", dev}
+	if bridged {
+		from = []string{"-m", "physdev", "--physdev-in", dev}
+		notFrom = []string{"-m", "physdev", "!", "--physdev-in", dev}
+	}
+
+	// MARK doesn't terminate, so the more specific workload groups are
+	// applied after the group of the whole lease. Packets decapsulated by the
+	// device already carry the group of their sender and are left alone.
+	tag := func(src string, group uint16) {
+		mark := []string{"-j", "MARK", "--set-xmark", fmt.Sprintf("%#x/%#x", group, gbpMask)}
+		prerouting := append(append([]string{}, notFrom...), "-s", src)
+		rules = append(rules,
+			IPTablesRule{"mangle", "PREROUTING", append(prerouting, mark...)},
+			IPTablesRule{"mangle", "OUTPUT", append([]string{"-s", src}, mark...)},
+		)
+	}
+	tag(lease.StringSep(".", "/"), g.Group)
+	for _, w := range g.Workloads {
+		tag(w.CIDR, w.Group)
+	}
+
+	// the device stores the group of received packets in their fwmark
+	enforce := func(match []string, action string) {
+		target := "ACCEPT"
+		if action == gbpDrop {
+			target = "DROP"
+		}
+		for _, chain := range []string{"FORWARD", "INPUT"} {
+			spec := append(append([]string{}, from...), match...)
+			rules = append(rules, IPTablesRule{"filter", chain, append(spec, "-j", target)})
+		}
+	}
+	for _, r := range g.Policy {
+		enforce([]string{"-m", "mark", "--mark", fmt.Sprintf("%#x/%#x", r.Group, gbpMask)}, r.Action)
+	}
+	if g.DefaultAction == gbpDrop {
+		enforce(nil, gbpDrop)
+	}
+
+	return rules
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGBPRules(t *testing.T) {
+	g := &gbpConfig{
+		Group:         10,
+		Workloads:     []gbpWorkload{{CIDR: "10.5.1.4/32", Group: 20}},
+		Policy:        []gbpRule{{Group: 20, Action: gbpAllow}},
+		DefaultAction: gbpDrop,
+	}
+	lease := testSubnet("10.5.1.0/24")
+
+	tests := []struct {
+		bridged bool
+		want    []IPTablesRule
+	}{
+		{false, []IPTablesRule{
+			{"mangle", "PREROUTING", []string{"!", "-i", "vxlan.1", "-s", "10.5.1.0/24", "-j", "MARK", "--set-xmark", "0xa/0xffff"}},
+			{"mangle", "OUTPUT", []string{"-s", "10.5.1.0/24", "-j", "MARK", "--set-xmark", "0xa/0xffff"}},
+			{"mangle", "PREROUTING", []string{"!", "-i", "vxlan.1", "-s", "10.5.1.4/32", "-j", "MARK", "--set-xmark", "0x14/0xffff"}},
+			{"mangle", "OUTPUT", []string{"-s", "10.5.1.4/32", "-j", "MARK", "--set-xmark", "0x14/0xffff"}},
+			{"filter", "FORWARD", []string{"-i", "vxlan.1", "-m", "mark", "--mark", "0x14/0xffff", "-j", "ACCEPT"}},
+			{"filter", "INPUT", []string{"-i", "vxlan.1", "-m", "mark", "--mark", "0x14/0xffff", "-j", "ACCEPT"}},
+			{"filter", "FORWARD", []string{"-i", "vxlan.1", "-j", "DROP"}},
+			{"filter", "INPUT", []string{"-i", "vxlan.1", "-j", "DROP"}},
+		}},
+		{true, []IPTablesRule{
+			{"mangle", "PREROUTING", []string{"-m", "physdev", "!", "--physdev-in", "vxlan.1", "-s", "10.5.1.0/24", "-j", "MARK", "--set-xmark", "0xa/0xffff"}},
+			{"mangle", "OUTPUT", []string{"-s", "10.5.1.0/24", "-j", "MARK", "--set-xmark", "0xa/0xffff"}},
+			{"mangle", "PREROUTING", []string{"-m", "physdev", "!", "--physdev-in", "vxlan.1", "-s", "10.5.1.4/32", "-j", "MARK", "--set-xmark", "0x14/0xffff"}},
+			{"mangle", "OUTPUT", []string{"-s", "10.5.1.4/32", "-j", "MARK", "--set-xmark", "0x14/0xffff"}},
+			{"filter", "FORWARD", []string{"-m", "physdev", "--physdev-in", "vxlan.1", "-m", "mark", "--mark", "0x14/0xffff", "-j", "ACCEPT"}},
+			{"filter", "INPUT", []string{"-m", "physdev", "--physdev-in", "vxlan.1", "-m", "mark", "--mark", "0x14/0xffff", "-j", "ACCEPT"}},
+			{"filter", "FORWARD", []string{"-m", "physdev", "--physdev-in", "vxlan.1", "-j", "DROP"}},
+			{"filter", "INPUT", []string{"-m", "physdev", "--physdev-in", "vxlan.1", "-j", "DROP"}},
+		}},
+	}
+	for _, tt := range tests {
+		got := gbpRules(g, "vxlan.1", tt.bridged, lease)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("bridged %v:\n got %q\nwant %q", tt.bridged, got, tt.want)
+		}
+	}
+}
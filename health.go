@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthzHandler reports whether the process is alive and every network's
+// watch loop made progress within timeout.
+func healthzHandler(networks []*network, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, n := range networks {
+			if err := n.healthy(timeout); err != nil {
+				http.Error(w, fmt.Sprintf("%s: %v", n.cfg.Name, err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// readyzHandler reports whether the node is on every overlay: lease acquired,
+// vxlan device up with its address, initial peers programmed and iptables
+// rules present.
+func readyzHandler(networks []*network) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, n := range networks {
+			if err := n.ready(); err != nil {
+				http.Error(w, fmt.Sprintf("%s: %v", n.cfg.Name, err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
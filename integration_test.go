@@ -0,0 +1,299 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// The integration tests build real devices and need root:
+//
+//	sudo go test -tags integration -run Integration
+
+type testNode struct {
+	ns  netns.NsHandle
+	nlh *nsHandle
+	dev *vxlanDevice
+}
+
+// newTestNamespaces returns two fresh network namespaces joined by a veth
+// pair, veth0 in the first at 192.168.100.1/24 and veth1 in the second at
+// 192.168.100.2/24.
+func newTestNamespaces(t *testing.T) [2]netns.NsHandle {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+	defer netns.Set(orig)
+
+	var nss [2]netns.NsHandle
+	for i := range nss {
+		if nss[i], err = netns.New(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nlh, err := netlink.NewHandleAt(nss[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nlh.Delete()
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"}
+	if err := nlh.LinkAdd(veth); err != nil {
+		t.Fatalf("failed to add veth pair: %v", err)
+	}
+	peer, err := nlh.LinkByName("veth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nlh.LinkSetNsFd(peer, int(nss[1])); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, ns := range nss {
+		h, err := netlink.NewHandleAt(ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Delete()
+
+		for _, name := range []string{"lo", fmt.Sprintf("veth%d", i)} {
+			link, err := h.LinkByName(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != "lo" {
+				addr, _ := netlink.ParseAddr(fmt.Sprintf("192.168.100.%d/24", i+1))
+				if err := h.AddrAdd(link, addr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := h.LinkSetUp(link); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return nss
+}
+
+// startTestNode runs a network of VNI 1 on veth<i> of ns, registered in the
+// registry of sm, the way newNetwork and run do.
+func startTestNode(ctx context.Context, t *testing.T, i int, ns netns.NsHandle, sm *manager, nc networkConfig) *testNode {
+	nlh, err := newNetlinkHandle(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := nlh.LinkByName(fmt.Sprintf("veth%d", i))
+	if err != nil {
+		t.Fatal(err)
+	}
+	extIface := &externalInterface{
+		Iface:     linkToInterface(link),
+		IfaceAddr: net.IPv4(192, 168, 100, byte(i+1)).To4(),
+		IfaceNet:  &net.IPNet{IP: net.IPv4(192, 168, 100, 0).To4(), Mask: net.CIDRMask(24, 32)},
+	}
+	extIface.ExtAddr = extIface.IfaceAddr
+
+	ipn, err := nc.ipNet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := newVxlanDevice(nlh, &vxlanDeviceAttrs{
+		vni:       nc.VNI,
+		name:      fmt.Sprintf("vxlan.%v", nc.VNI),
+		vtepIndex: extIface.Iface.Index,
+		vtepAddr:  extIface.IfaceAddr,
+		mode:      nc.Mode,
+		overlay:   ipn.ToIPNet(),
+		publicIP:  FromIP(extIface.ExtAddr),
+		localNet:  extIface.IfaceNet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.network = nc.Name
+
+	sn, err := sm.acquireLease(ctx, ipn, nc.SubnetLen, Attrs{
+		PublicIP:     FromIP(extIface.ExtAddr),
+		VtepIP:       FromIP(extIface.IfaceAddr),
+		HardwareAddr: dev.link.HardwareAddr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.lease = sn
+	if err := dev.configure(fmt.Sprintf("%v/32", sn.IP.ToIP())); err != nil {
+		t.Fatal(err)
+	}
+
+	go handleSubnets(ctx, sn, sm, dev)
+	return &testNode{ns: ns, nlh: nlh, dev: dev}
+}
+
+// ping sends ICMP echo requests to dst from within ns until one is answered.
+func ping(ns netns.NsHandle, dst net.IP, timeout time.Duration) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer orig.Close()
+	if err := netns.Set(ns); err != nil {
+		return err
+	}
+	defer netns.Set(orig)
+
+	c, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// echo request, id 0x1234, seq 1
+	req := []byte{8, 0, 0, 0, 0x12, 0x34, 0, 1, 'v', 'x', 'l', 'a', 'n'}
+	var sum uint32
+	for i := 0; i < len(req)-1; i += 2 {
+		sum += uint32(req[i])<<8 | uint32(req[i+1])
+	}
+	sum += uint32(req[len(req)-1]) << 8
+	sum = sum>>16 + sum&0xffff
+	sum += sum >> 16
+	req[2], req[3] = byte(^sum>>8), byte(^sum)
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if _, err := c.WriteTo(req, &net.IPAddr{IP: dst}); err != nil {
+			return err
+		}
+		c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		for {
+			n, from, err := c.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			// echo reply with our id
+			if from.(*net.IPAddr).IP.Equal(dst) && n >= 8 && buf[0] == 0 && buf[4] == 0x12 && buf[5] == 0x34 {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no echo reply from %s within %v", dst, timeout)
+}
+
+func TestIntegrationPingAcrossOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create network namespaces")
+	}
+
+	nss := newTestNamespaces(t)
+	defer nss[0].Close()
+	defer nss[1].Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nc := networkConfig{Name: "test", VNI: 1, Network: "10.5.0.0/16", SubnetLen: 24, Prefix: "/vxlan/test", Mode: modeUnicast}
+	reg := newFakeKeysAPI()
+	var nodes [2]*testNode
+	for i, ns := range nss {
+		sm := &manager{cli: reg, Prefix: nc.Prefix, network: nc.Name}
+		nodes[i] = startTestNode(ctx, t, i, ns, sm, nc)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for _, n := range nodes {
+		for {
+			err := n.dev.checkReady()
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not ready: %v", n.dev.lease.StringSep(".", "/"), err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	for i, n := range nodes {
+		dst := nodes[1-i].dev.lease.IP.ToIP()
+		if err := ping(n.ns, dst, 5*time.Second); err != nil {
+			t.Fatalf("ping %s from %s: %v", dst, n.dev.lease.StringSep(".", "/"), err)
+		}
+	}
+}
+
+func TestIntegrationUpdateLinkInPlace(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create network namespaces")
+	}
+
+	nss := newTestNamespaces(t)
+	defer nss[0].Close()
+	defer nss[1].Close()
+
+	nlh, err := newNetlinkHandle(nss[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	veth, err := nlh.LinkByName("veth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := &vxlanDeviceAttrs{
+		vni:       1,
+		name:      "vxlan.1",
+		vtepIndex: veth.Attrs().Index,
+		vtepAddr:  net.IPv4(192, 168, 100, 1).To4(),
+		vtepPort:  4789,
+		portLow:   49152,
+		portHigh:  49407,
+		udpCSum:   true,
+		mode:      modeBridge,
+	}
+	created, err := ensureLink(nlh, newVxlanLink(attrs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs.mtu = 1400
+	attrs.ttl = 64
+	attrs.tos = 1
+	updated, err := ensureLink(nlh, newVxlanLink(attrs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Index != created.Index {
+		t.Fatalf("device was recreated instead of updated")
+	}
+	if updated.MTU != 1400 || updated.TTL != 64 || updated.TOS != 1 || !updated.Learning || !updated.Proxy || updated.Port != 4789 {
+		t.Fatalf("unexpected device %+v", updated)
+	}
+
+	attrs.mode = modeUnicast
+	updated, err = ensureLink(nlh, newVxlanLink(attrs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Learning || updated.Proxy {
+		t.Fatalf("unexpected device %+v", updated)
+	}
+}
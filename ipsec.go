@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/coreos/etcd/client"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	encryptionIPsec = "ipsec"
+
+	ipsecSecretLen = 32
+	// ipsecAlgo is AES-128-GCM with a 128 bit ICV; its key material is the
+	// AES key followed by a 4 byte salt
+	ipsecAlgo   = "rfc4106(gcm(aes))"
+	ipsecKeyLen = 20
+
+	ipsecNonceLen = 16
+	// ipsecReplayWindow is the number of packets an inbound SA accepts out of
+	// order, older and repeated ones are dropped
+	ipsecReplayWindow = 32
+
+	// ipsecReqidBase sets our SAs and policies apart from those of IKE
+	// daemons like strongSwan or libreswan, which allocate small reqids;
+	// the lower 24 bits hold the VNI
+	ipsecReqidBase = 0x7e000000
+)
+
+// ipsecSecret returns the pre-shared secret of the network, creating it in
+// the registry if no node has done so yet.
+func (m *manager) ipsecSecret(ctx context.Context) ([]byte, error) {
+	key := path.Join(m.Prefix, "ipsec", "secret")
+
+	resp, err := m.cli.Get(ctx, key, &client.GetOptions{Quorum: true})
+	if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeKeyNotFound {
+		secret := make([]byte, ipsecSecretLen)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+
+		_, err = m.cli.Set(ctx, key, hex.EncodeToString(secret), &client.SetOptions{PrevExist: client.PrevNoExist})
+		if err == nil {
+			logrus.Infof("[%s] created IPsec secret", m.network)
+			return secret, nil
+		}
+		if etcdErr, ok := err.(client.Error); !ok || etcdErr.Code != client.ErrorCodeNodeExist {
+			return nil, err
+		}
+
+		// another node was faster
+		resp, err = m.cli.Get(ctx, key, &client.GetOptions{Quorum: true})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := hex.DecodeString(resp.Node.Value)
+	if err != nil || len(secret) < ipsecSecretLen {
+		return nil, fmt.Errorf("invalid IPsec secret in %s", key)
+	}
+	return secret, nil
+}
+
+// newIPsecNonce returns a fresh nonce for our lease.
+func newIPsecNonce() ([]byte, error) {
+	nonce := make([]byte, ipsecNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate IPsec nonce: %v", err)
+	}
+	return nonce, nil
+}
+
+// ipsecDerive derives the material for label of the traffic from the node
+// leasing src to the node leasing dst. Both ends compute the same value.
+// The nonces the nodes published make the keys differ between their runs:
+// an SA installed again starts its sequence numbers, and with them the GCM
+// IVs, from scratch and must never do so with a key used before.
+func ipsecDerive(secret []byte, label string, vni uint32, src, dst IP4Net, srcNonce, dstNonce []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	fmt.Fprintf(h, "%s|%v|%s|%s|%x|%x", label, vni, src.StringSep(".", "/"), dst.StringSep(".", "/"), srcNonce, dstNonce)
+	return h.Sum(nil)
+}
+
+// ipsecReqid returns the reqid of the SAs and policies of the network.
+func (dev *vxlanDevice) ipsecReqid() int {
+	return ipsecReqidBase | int(dev.attrs.vni)
+}
+
+// ipsecSA returns the transport mode SA protecting the traffic from the node
+// leasing srcSn at src with srcNonce to the node leasing dstSn at dst with
+// dstNonce. Extended sequence numbers keep it from running out of sequence
+// numbers, which would stop it from sending, however long it lives.
+func (dev *vxlanDevice) ipsecSA(src, dst net.IP, srcSn, dstSn IP4Net, srcNonce, dstNonce []byte) *netlink.XfrmState {
+	derive := func(label string) []byte {
+		return ipsecDerive(dev.attrs.ipsecSecret, label, dev.attrs.vni, srcSn, dstSn, srcNonce, dstNonce)
+	}
+	spi := binary.BigEndian.Uint32(derive("spi"))
+	return &netlink.XfrmState{
+		Src:   src,
+		Dst:   dst,
+		Proto: netlink.XFRM_PROTO_ESP,
+		Mode:  netlink.XFRM_MODE_TRANSPORT,
+		// SPIs below 256 are reserved
+		Spi:   int(spi&0x7fffffff | 0x100),
+		Reqid: dev.ipsecReqid(),
+		Aead: &netlink.XfrmStateAlgo{
+			Name:   ipsecAlgo,
+			Key:    derive("key")[:ipsecKeyLen],
+			ICVLen: 128,
+		},
+		// the kernel wants a replay window with ESN on outbound SAs too
+		ReplayWindow: ipsecReplayWindow,
+		ESN:          true,
+	}
+}
+
+// ipsecPolicy returns the policy requiring the vxlan traffic from src to dst
+// to use sa.
+func (dev *vxlanDevice) ipsecPolicy(dir netlink.Dir, sa *netlink.XfrmState) *netlink.XfrmPolicy {
+	return &netlink.XfrmPolicy{
+		Src:     &net.IPNet{IP: sa.Src, Mask: net.CIDRMask(32, 32)},
+		Dst:     &net.IPNet{IP: sa.Dst, Mask: net.CIDRMask(32, 32)},
+		Proto:   netlink.Proto(syscall.IPPROTO_UDP),
+		DstPort: vxlanPort(dev.attrs.vtepPort),
+		Dir:     dir,
+		Tmpls: []netlink.XfrmPolicyTmpl{{
+			Src:   sa.Src,
+			Dst:   sa.Dst,
+			Proto: sa.Proto,
+			Mode:  sa.Mode,
+			Reqid: sa.Reqid,
+		}},
+	}
+}
+
+// peerIPsec returns the SAs and policies of both directions between local
+// and the peer sn.
+func (dev *vxlanDevice) peerIPsec(local net.IP, sn IP4Net, p *peer) ([]*netlink.XfrmState, []*netlink.XfrmPolicy) {
+	remote := dev.peerVtepIP(p.attrs)
+	out := dev.ipsecSA(local, remote, dev.lease, sn, dev.attrs.ipsecNonce, p.attrs.IPsecNonce)
+	in := dev.ipsecSA(remote, local, sn, dev.lease, p.attrs.IPsecNonce, dev.attrs.ipsecNonce)
+
+	return []*netlink.XfrmState{out, in},
+		[]*netlink.XfrmPolicy{dev.ipsecPolicy(netlink.XFRM_DIR_OUT, out), dev.ipsecPolicy(netlink.XFRM_DIR_IN, in)}
+}
+
+// addPeerIPsec encrypts the vxlan traffic with the peer sn. Policies left
+// from before a restart are identical and kept, SAs were flushed by
+// flushIPsecSAs.
+func (dev *vxlanDevice) addPeerIPsec(sn IP4Net, p *peer) error {
+	states, policies := dev.peerIPsec(dev.attrs.vtepAddr, sn, p)
+	for _, sa := range states {
+		if err := dev.nlh.XfrmStateAdd(sa); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add SA %s -> %s: %v", sa.Src, sa.Dst, err)
+		}
+	}
+	for _, pol := range policies {
+		if err := dev.nlh.XfrmPolicyAdd(pol); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add policy %s -> %s: %v", pol.Src, pol.Dst, err)
+		}
+	}
+	return nil
+}
+
+// delPeerIPsec removes what addPeerIPsec installed for the peer sn when our
+// VTEP address was local.
+func (dev *vxlanDevice) delPeerIPsec(local net.IP, sn IP4Net, p *peer) error {
+	states, policies := dev.peerIPsec(local, sn, p)
+	var lastErr error
+	for _, pol := range policies {
+		if err := dev.nlh.XfrmPolicyDel(pol); err != nil && err != syscall.ENOENT {
+			lastErr = fmt.Errorf("failed to delete policy %s -> %s: %v", pol.Src, pol.Dst, err)
+		}
+	}
+	for _, sa := range states {
+		if err := dev.nlh.XfrmStateDel(sa); err != nil && err != syscall.ESRCH {
+			lastErr = fmt.Errorf("failed to delete SA %s -> %s: %v", sa.Src, sa.Dst, err)
+		}
+	}
+	return lastErr
+}
+
+// flushIPsecSAs deletes the SAs of the network left from before a restart,
+// those with our reqid to or from our VTEP address. Their keys were derived
+// from our previous nonce and are replaced as peers are added; the policies
+// stay so nothing is sent in cleartext meanwhile.
+func (dev *vxlanDevice) flushIPsecSAs() error {
+	states, err := dev.nlh.XfrmStateList(syscall.AF_INET)
+	if err != nil {
+		return fmt.Errorf("failed to list SAs: %v", err)
+	}
+	for i := range states {
+		sa := &states[i]
+		if sa.Proto != netlink.XFRM_PROTO_ESP || sa.Mode != netlink.XFRM_MODE_TRANSPORT || sa.Reqid != dev.ipsecReqid() {
+			continue
+		}
+		if !sa.Src.Equal(dev.attrs.vtepAddr) && !sa.Dst.Equal(dev.attrs.vtepAddr) {
+			continue
+		}
+		if err := dev.nlh.XfrmStateDel(sa); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to delete SA %s -> %s: %v", sa.Src, sa.Dst, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestIPsecDerive(t *testing.T) {
+	secret := make([]byte, ipsecSecretLen)
+	a, b := testSubnet("10.5.1.0/24"), testSubnet("10.5.2.0/24")
+	n1, n2, n3 := []byte{1}, []byte{2}, []byte{3}
+
+	key := ipsecDerive(secret, "key", 1, a, b, n1, n2)
+	if !bytes.Equal(key, ipsecDerive(secret, "key", 1, a, b, n1, n2)) {
+		t.Fatal("both ends derive different keys")
+	}
+	if bytes.Equal(key, ipsecDerive(secret, "key", 1, b, a, n2, n1)) {
+		t.Fatal("both directions share a key")
+	}
+	if bytes.Equal(key, ipsecDerive(secret, "key", 1, a, b, n3, n2)) || bytes.Equal(key, ipsecDerive(secret, "key", 1, a, b, n1, n3)) {
+		t.Fatal("key reused after a restart")
+	}
+}
+
+func TestAddPeerIPsecRequiresNonce(t *testing.T) {
+	dev, f := newTestDevice(t, modeUnicast)
+	dev.attrs.ipsecSecret = make([]byte, ipsecSecretLen)
+	dev.attrs.ipsecNonce = []byte{1}
+
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: testPeer}}, false)
+	assertEmpty(t, f)
+	if p := dev.peers[testPeerSn]; p.ipsec || p.route || p.lastErr == nil {
+		t.Fatalf("peer without a nonce programmed: %+v", p)
+	}
+}
+
+func TestAddPeerIPsecRekeysOnRestart(t *testing.T) {
+	dev, f := newTestDevice(t, modeUnicast)
+	dev.attrs.ipsecSecret = make([]byte, ipsecSecretLen)
+	dev.attrs.ipsecNonce = []byte{1}
+
+	peer := testPeer
+	peer.IPsecNonce = []byte{2}
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: peer}}, false)
+	keys := map[string]bool{}
+	for _, sa := range f.states {
+		keys[string(sa.Aead.Key)] = true
+		if sa.Dst.Equal(dev.attrs.vtepAddr) && sa.ReplayWindow == 0 {
+			t.Fatal("inbound SA without replay protection")
+		}
+		if !sa.ESN || sa.Reqid != ipsecReqidBase|1 {
+			t.Fatalf("SA %s -> %s without ESN or our reqid: %+v", sa.Src, sa.Dst, sa)
+		}
+	}
+
+	// the peer restarted with a new nonce
+	peer.IPsecNonce = []byte{3}
+	dev.handleSubnetEvents([]Event{{Type: eventAdd, Subnet: testPeerSn, Attrs: peer}}, false)
+	if len(f.states) != 2 || len(f.policies) != 2 {
+		t.Fatalf("got %v SAs and %v policies, want 2 of each", len(f.states), len(f.policies))
+	}
+	for _, sa := range f.states {
+		if keys[string(sa.Aead.Key)] {
+			t.Fatalf("SA %s -> %s reinstalled with its old key", sa.Src, sa.Dst)
+		}
+	}
+}
+
+func TestNewVxlanDeviceFlushesSAs(t *testing.T) {
+	f := newFakeNetlink()
+	local, remote := net.IPv4(192, 168, 100, 1), net.IPv4(192, 168, 100, 2)
+	esp := func(src, dst net.IP, spi, reqid int) *netlink.XfrmState {
+		return &netlink.XfrmState{Src: src, Dst: dst, Proto: netlink.XFRM_PROTO_ESP, Mode: netlink.XFRM_MODE_TRANSPORT, Spi: spi, Reqid: reqid}
+	}
+	stale := []*netlink.XfrmState{
+		esp(local, remote, 0x100, ipsecReqidBase|1),
+		esp(remote, local, 0x101, ipsecReqidBase|1),
+	}
+	kept := []*netlink.XfrmState{
+		// an IKE daemon's SA that happens to have the VNI as reqid
+		esp(local, remote, 0x200, 1),
+		// another network
+		esp(local, remote, 0x300, ipsecReqidBase|2),
+		// another instance of the network with a different VTEP address
+		esp(net.IPv4(192, 168, 100, 3), remote, 0x400, ipsecReqidBase|1),
+	}
+	for _, sa := range append(stale, kept...) {
+		if err := f.XfrmStateAdd(sa); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := newVxlanDevice(f, &vxlanDeviceAttrs{
+		vni:         1,
+		name:        "vxlan.1",
+		vtepAddr:    local.To4(),
+		mode:        modeUnicast,
+		ipsecSecret: make([]byte, ipsecSecretLen),
+		ipsecNonce:  []byte{1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sa := range stale {
+		if _, ok := f.states[stateKey(sa)]; ok {
+			t.Fatalf("SA %s -> %s of the previous run left behind", sa.Src, sa.Dst)
+		}
+	}
+	for _, sa := range kept {
+		if _, ok := f.states[stateKey(sa)]; !ok {
+			t.Fatalf("SA %s -> %s with reqid %#x deleted", sa.Src, sa.Dst, sa.Reqid)
+		}
+	}
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netns"
 )
 
 type IPTables interface {
@@ -15,6 +17,24 @@ type IPTables interface {
 	Exists(table string, chain string, rulespec ...string) (bool, error)
 }
 
+// ipTablesStatus records whether the last resync left all rules in place.
+type ipTablesStatus struct {
+	mu sync.Mutex
+	ok bool
+}
+
+func (s *ipTablesStatus) set(ok bool) {
+	s.mu.Lock()
+	s.ok = ok
+	s.mu.Unlock()
+}
+
+func (s *ipTablesStatus) get() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ok
+}
+
 type IPTablesRule struct {
 	table    string
 	chain    string
@@ -44,7 +64,13 @@ func ipTablesRulesExist(ipt IPTables, rules []IPTablesRule) (bool, error) {
 	return true, nil
 }
 
-func setupAndEnsureIPTables(rules []IPTablesRule, resyncPeriod int) {
+func setupAndEnsureIPTables(ns netns.NsHandle, rules []IPTablesRule, resyncPeriod int, status *ipTablesStatus) {
+	// iptables must run in the namespace the vxlan device lives in
+	if err := enterNetns(ns); err != nil {
+		logrus.Errorf("Failed to setup IPTables. could not enter network namespace: %v", err)
+		return
+	}
+
 	ipt, err := iptables.New()
 	if err != nil {
 		// if we can't find iptables, give up and return
@@ -58,9 +84,11 @@ func setupAndEnsureIPTables(rules []IPTablesRule, resyncPeriod int) {
 
 	for {
 		// Ensure that all the iptables rules exist every 5 seconds
-		if err := ensureIPTables(ipt, rules); err != nil {
+		err := ensureIPTables(ipt, rules)
+		if err != nil {
 			logrus.Errorf("Failed to ensure iptables rules: %v", err)
 		}
+		status.set(err == nil)
 
 		time.Sleep(time.Duration(resyncPeriod) * time.Second)
 	}
@@ -78,6 +106,7 @@ func ensureIPTables(ipt IPTables, rules []IPTablesRule) error {
 	// Otherwise, teardown all the rules and set them up again
 	// We do this because the order of the rules is important
 	logrus.Info("Some iptables rules are missing; deleting and recreating rules")
+	iptablesMissingRulesCounter.Inc()
 	teardownIPTables(ipt, rules)
 	if err = setupIPTables(ipt, rules); err != nil {
 		return fmt.Errorf("Error setting up rules: %v", err)
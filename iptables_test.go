@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeIPTables keeps the rules of each table/chain in order, like iptables
+// does for a chain.
+type fakeIPTables struct {
+	chains map[string][]string
+
+	existsErr error
+	appendErr error
+}
+
+func newFakeIPTables() *fakeIPTables {
+	return &fakeIPTables{chains: map[string][]string{}}
+}
+
+func (f *fakeIPTables) key(table, chain string) string {
+	return table + "/" + chain
+}
+
+func (f *fakeIPTables) index(table, chain string, rulespec []string) int {
+	spec := strings.Join(rulespec, " ")
+	for i, r := range f.chains[f.key(table, chain)] {
+		if r == spec {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *fakeIPTables) AppendUnique(table string, chain string, rulespec ...string) error {
+	if f.appendErr != nil {
+		return f.appendErr
+	}
+	if f.index(table, chain, rulespec) >= 0 {
+		return nil
+	}
+	k := f.key(table, chain)
+	f.chains[k] = append(f.chains[k], strings.Join(rulespec, " "))
+	return nil
+}
+
+func (f *fakeIPTables) Delete(table string, chain string, rulespec ...string) error {
+	i := f.index(table, chain, rulespec)
+	if i < 0 {
+		return errors.New("iptables: Bad rule (does a matching rule exist in that chain?)")
+	}
+	k := f.key(table, chain)
+	f.chains[k] = append(f.chains[k][:i], f.chains[k][i+1:]...)
+	return nil
+}
+
+func (f *fakeIPTables) Exists(table string, chain string, rulespec ...string) (bool, error) {
+	if f.existsErr != nil {
+		return false, f.existsErr
+	}
+	return f.index(table, chain, rulespec) >= 0, nil
+}
+
+func (f *fakeIPTables) rules(table, chain string) []string {
+	return f.chains[f.key(table, chain)]
+}
+
+var testRules = []IPTablesRule{
+	{"mangle", "PREROUTING", []string{"-s", "10.5.1.0/24", "-j", "MARK", "--set-xmark", "0x1/0xffff"}},
+	{"filter", "FORWARD", []string{"-s", "10.5.0.0/16", "-j", "ACCEPT"}},
+	{"filter", "FORWARD", []string{"-d", "10.5.0.0/16", "-j", "ACCEPT"}},
+}
+
+func TestIPTablesRulesExist(t *testing.T) {
+	ipt := newFakeIPTables()
+
+	exists, err := ipTablesRulesExist(ipt, testRules)
+	if err != nil || exists {
+		t.Fatalf("empty tables: got %v, %v; want false, nil", exists, err)
+	}
+
+	if err := setupIPTables(ipt, testRules); err != nil {
+		t.Fatal(err)
+	}
+	exists, err = ipTablesRulesExist(ipt, testRules)
+	if err != nil || !exists {
+		t.Fatalf("after setup: got %v, %v; want true, nil", exists, err)
+	}
+
+	ipt.Delete("filter", "FORWARD", testRules[2].rulespec...)
+	exists, err = ipTablesRulesExist(ipt, testRules)
+	if err != nil || exists {
+		t.Fatalf("with a rule missing: got %v, %v; want false, nil", exists, err)
+	}
+
+	ipt.existsErr = errors.New("exit status 4")
+	if _, err := ipTablesRulesExist(ipt, testRules); err == nil {
+		t.Fatal("expected the Exists error to be returned")
+	}
+}
+
+func TestSetupIPTables(t *testing.T) {
+	ipt := newFakeIPTables()
+	if err := setupIPTables(ipt, testRules); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"-s 10.5.0.0/16 -j ACCEPT", "-d 10.5.0.0/16 -j ACCEPT"}
+	if got := ipt.rules("filter", "FORWARD"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("FORWARD: got %q, want %q", got, want)
+	}
+
+	// setting up twice doesn't duplicate anything
+	if err := setupIPTables(ipt, testRules); err != nil {
+		t.Fatal(err)
+	}
+	if got := ipt.rules("filter", "FORWARD"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("FORWARD after second setup: got %q, want %q", got, want)
+	}
+
+	ipt.appendErr = errors.New("exit status 1")
+	if err := setupIPTables(newFakeIPTables(), testRules); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupIPTables(ipt, testRules); err == nil {
+		t.Fatal("expected the AppendUnique error to be returned")
+	}
+}
+
+func TestTeardownIPTables(t *testing.T) {
+	ipt := newFakeIPTables()
+	ipt.AppendUnique("filter", "FORWARD", "-i", "eth0", "-j", "ACCEPT")
+	if err := setupIPTables(ipt, testRules); err != nil {
+		t.Fatal(err)
+	}
+	ipt.Delete("mangle", "PREROUTING", testRules[0].rulespec...)
+
+	// missing rules are ignored and foreign ones are left alone
+	teardownIPTables(ipt, testRules)
+
+	if got := ipt.rules("mangle", "PREROUTING"); len(got) != 0 {
+		t.Fatalf("PREROUTING: got %q, want nothing", got)
+	}
+	want := []string{"-i eth0 -j ACCEPT"}
+	if got := ipt.rules("filter", "FORWARD"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("FORWARD: got %q, want %q", got, want)
+	}
+}
+
+func TestEnsureIPTables(t *testing.T) {
+	ipt := newFakeIPTables()
+	if err := ensureIPTables(ipt, testRules); err != nil {
+		t.Fatal(err)
+	}
+	exists, err := ipTablesRulesExist(ipt, testRules)
+	if err != nil || !exists {
+		t.Fatalf("after ensure: got %v, %v; want true, nil", exists, err)
+	}
+}
+
+func TestEnsureIPTablesPartialLoss(t *testing.T) {
+	ipt := newFakeIPTables()
+	if err := setupIPTables(ipt, testRules); err != nil {
+		t.Fatal(err)
+	}
+
+	// someone flushed our first FORWARD rule and appended one of theirs, which
+	// now sits between our two
+	ipt.Delete("filter", "FORWARD", testRules[1].rulespec...)
+	ipt.AppendUnique("filter", "FORWARD", "-i", "eth0", "-j", "DROP")
+	ipt.AppendUnique("filter", "FORWARD", testRules[1].rulespec...)
+	ipt.Delete("filter", "FORWARD", testRules[2].rulespec...)
+
+	if err := ensureIPTables(ipt, testRules); err != nil {
+		t.Fatal(err)
+	}
+
+	// all of our rules are recreated together, in their order
+	want := []string{"-i eth0 -j DROP", "-s 10.5.0.0/16 -j ACCEPT", "-d 10.5.0.0/16 -j ACCEPT"}
+	if got := ipt.rules("filter", "FORWARD"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("FORWARD: got %q, want %q", got, want)
+	}
+	want = []string{"-s 10.5.1.0/24 -j MARK --set-xmark 0x1/0xffff"}
+	if got := ipt.rules("mangle", "PREROUTING"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("PREROUTING: got %q, want %q", got, want)
+	}
+
+	// nothing is touched once everything is in place
+	ipt.AppendUnique("filter", "FORWARD", "-o", "eth0", "-j", "DROP")
+	if err := ensureIPTables(ipt, testRules); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"-i eth0 -j DROP", "-s 10.5.0.0/16 -j ACCEPT", "-d 10.5.0.0/16 -j ACCEPT", "-o eth0 -j DROP"}
+	if got := ipt.rules("filter", "FORWARD"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("FORWARD: got %q, want %q", got, want)
+	}
+}
+
+func TestEnsureIPTablesExistsError(t *testing.T) {
+	ipt := newFakeIPTables()
+	ipt.existsErr = errors.New("exit status 4")
+
+	if err := ensureIPTables(ipt, testRules); err == nil {
+		t.Fatal("expected the Exists error to be returned")
+	}
+	// rules are not recreated blindly when their state is unknown
+	for _, r := range testRules {
+		if got := ipt.rules(r.table, r.chain); len(got) != 0 {
+			t.Fatalf("%s/%s: got %q, want nothing", r.table, r.chain, got)
+		}
+	}
+}
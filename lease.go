@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const leaseUsage = `usage: vxlan lease <command> [flags]
+
+commands:
+  list                              list all leases
+  show <subnet>                     show one lease
+  delete <subnet>                   delete a lease, e.g. of a dead node
+  reservations                      list all reservations
+  reserve <subnet> -public-ip <ip>  always give subnet to the node with ip
+  unreserve <subnet>                remove a reservation`
+
+// runLease implements the `vxlan lease` subcommands.
+func runLease(args []string) error {
+	if len(args) == 0 {
+		return errors.New(leaseUsage)
+	}
+	cmd, args := args[0], args[1:]
+
+	cfg := config{}
+	var networkName, publicIP string
+	var asJSON bool
+	fs := flag.NewFlagSet("lease "+cmd, flag.ExitOnError)
+	fs.StringVar(&cfg.etcdEndpoint, "etcdEndpoint", "http://127.0.0.1:2379", "etcd endpoint")
+	fs.StringVar(&cfg.networksFile, "networks", "", "JSON file listing the overlay networks")
+	fs.StringVar(&networkName, "network", "", "network to operate on, defaults to the first one")
+	fs.StringVar(&publicIP, "public-ip", "", "public IP the reserved subnet is bound to")
+	fs.BoolVar(&asJSON, "json", false, "print JSON")
+
+	// allow flags both before and after the subnet argument
+	fs.Parse(args)
+	var positional []string
+	for fs.NArg() > 0 {
+		positional = append(positional, fs.Arg(0))
+		fs.Parse(fs.Args()[1:])
+	}
+
+	networks, err := loadNetworks(cfg.networksFile)
+	if err != nil {
+		return err
+	}
+	nc := networks[0]
+	if networkName != "" {
+		found := false
+		for _, n := range networks {
+			if n.Name == networkName {
+				nc, found = n, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown network %q", networkName)
+		}
+	}
+
+	sm := newManager(cfg, nc)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch cmd {
+	case "list":
+		leases, err := sm.getLeases(ctx)
+		if err != nil {
+			return err
+		}
+
+		statuses := make([]leaseStatus, 0, len(leases))
+		for _, l := range leases {
+			statuses = append(statuses, l.status())
+		}
+		if asJSON {
+			return printJSON(statuses)
+		}
+		printLeases(statuses)
+		return nil
+
+	case "reservations":
+		reservations, err := sm.getReservations(ctx)
+		if err != nil {
+			return err
+		}
+
+		statuses := make([]reservationStatus, 0, len(reservations))
+		for _, r := range reservations {
+			statuses = append(statuses, reservationStatus{
+				Subnet:   r.Subnet.StringSep(".", "/"),
+				PublicIP: r.PublicIP.ToIP().String(),
+			})
+		}
+		if asJSON {
+			return printJSON(statuses)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SUBNET\tPUBLIC IP")
+		for _, r := range statuses {
+			fmt.Fprintf(w, "%s\t%s\n", r.Subnet, r.PublicIP)
+		}
+		w.Flush()
+		return nil
+
+	case "show", "delete", "reserve", "unreserve":
+		if len(positional) != 1 {
+			return fmt.Errorf("lease %s takes exactly one subnet\n%s", cmd, leaseUsage)
+		}
+		sn, err := parseSubnetArg(positional[0], nc)
+		if err != nil {
+			return err
+		}
+
+		switch cmd {
+		case "show":
+			l, err := sm.getLease(ctx, *sn)
+			if err != nil {
+				return err
+			}
+			if asJSON {
+				return printJSON(l.status())
+			}
+			printLeases([]leaseStatus{l.status()})
+
+		case "delete":
+			if err := sm.deleteLease(ctx, *sn); err != nil {
+				return err
+			}
+			fmt.Printf("deleted lease %s\n", sn.StringSep(".", "/"))
+
+		case "reserve":
+			ip := net.ParseIP(publicIP)
+			if ip == nil || ip.To4() == nil {
+				return fmt.Errorf("lease reserve needs a valid -public-ip, got %q", publicIP)
+			}
+			if err := sm.reserveSubnet(ctx, *sn, FromIP(ip)); err != nil {
+				return err
+			}
+			fmt.Printf("reserved subnet %s for %s\n", sn.StringSep(".", "/"), ip)
+
+		case "unreserve":
+			if err := sm.unreserveSubnet(ctx, *sn); err != nil {
+				return err
+			}
+			fmt.Printf("removed reservation of %s\n", sn.StringSep(".", "/"))
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown lease command %q\n%s", cmd, leaseUsage)
+	}
+}
+
+type reservationStatus struct {
+	Subnet   string `json:"subnet"`
+	PublicIP string `json:"publicIP"`
+}
+
+// parseSubnetArg accepts a subnet as 10.5.1.0/24 or in key form 10.5.1.0-24
+// and checks it is a subnet of the network.
+func parseSubnetArg(s string, nc networkConfig) (*IP4Net, error) {
+	sn := ParseSubnetKey(strings.Replace(s, "/", "-", 1))
+	if sn == nil {
+		return nil, fmt.Errorf("invalid subnet %q", s)
+	}
+
+	ipn, err := nc.ipNet()
+	if err != nil {
+		return nil, err
+	}
+	if sn.PrefixLen != nc.SubnetLen || !ipn.ToIPNet().Contains(sn.IP.ToIP()) {
+		return nil, fmt.Errorf("%s is not a /%v subnet of %s", s, nc.SubnetLen, nc.Network)
+	}
+
+	return sn, nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printLeases(leases []leaseStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBNET\tPUBLIC IP\tVTEP MAC\tPORT\tEXPIRES")
+	for _, l := range leases {
+		expires := "never"
+		if l.Expiration != nil {
+			expires = l.Expiration.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\n", l.Subnet, l.PublicIP, l.VtepMAC, l.Port, expires)
+	}
+	w.Flush()
+}
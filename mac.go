@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+func machineID() (string, error) {
+	for _, f := range machineIDFiles {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	}
+
+	return "", errors.New("no machine-id found")
+}
+
+// vtepMAC derives a MAC address for the vxlan device of vni from the node's
+// identity, so that it survives device recreation and reboots. The address is
+// unicast and locally administered.
+func vtepMAC(nodeID string, vni uint32) net.HardwareAddr {
+	h := sha256.New()
+	h.Write([]byte(nodeID))
+	binary.Write(h, binary.BigEndian, vni)
+	sum := h.Sum(nil)
+
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = (mac[0] &^ 0x01) | 0x02
+	return mac
+}
+
+// gatewayMAC derives the MAC of the bridge holding the gateway address in
+// bridge mode. It only depends on vni, so every node answers for the gateway
+// with the same address and a migrated workload's ARP entry stays valid.
+func gatewayMAC(vni uint32) net.HardwareAddr {
+	return vtepMAC("gateway", vni)
+}
@@ -9,6 +9,8 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"regexp"
+	"strings"
 	"syscall"
 	"time"
 
@@ -22,74 +24,145 @@ func init() {
 
 const (
 	defaultVNI            = 1
+	defaultNetwork        = "10.5.0.0/16"
+	defaultSubnetLen      = 24
+	defaultPrefix         = "/vxlan"
 	iptablesResyncSeconds = 5
-	encapOverhead         = 50
-	vxlanNetwork          = "10.5.0.0/16"
-	subNetworkTpl         = "10.5.%v.0"
+	// defaultVxlanPort is the kernel's default UDP destination port
+	defaultVxlanPort    = 8472
+	encapOverhead       = 50
+	watchTimeoutSeconds = 30
+	subnetTTL           = 24 * time.Hour
+	leaseRetryInterval  = time.Minute
+	maxLeaseAttempts    = 10
+	// endpointTTL bounds how long the workloads of a dead node are
+	// advertised; live nodes refresh theirs every endpointTTL/4
+	endpointTTL = 2 * time.Minute
 )
 
 type config struct {
-	etcdEndpoint string
+	etcdEndpoint  string
+	netns         string
+	networksFile  string
+	httpAddr      string
+	healthTimeout time.Duration
+	statusSocket  string
+	ifaces        stringSlice
+	ifaceRegexes  stringSlice
+	ifaceCanReach string
+	publicIP      string
+	publicIPURL   string
+}
+
+// stringSlice is a flag that can be repeated.
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "status":
+			if err := runStatus(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		case "lease":
+			if err := runLease(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	runDaemon()
+}
+
+func runDaemon() {
 	cfg := config{}
 	flag.StringVar(&cfg.etcdEndpoint, "etcdEndpoint", "http://127.0.0.1:2379", "etcd endpoint")
+	flag.StringVar(&cfg.netns, "netns", "", "network namespace (path or name) to manage the vxlan device in")
+	flag.StringVar(&cfg.networksFile, "networks", "", "JSON file listing the overlay networks to serve")
+	flag.StringVar(&cfg.httpAddr, "httpAddr", ":9586", "address to serve /metrics, /healthz and /readyz on, empty to disable")
+	flag.DurationVar(&cfg.healthTimeout, "healthTimeout", 2*watchTimeoutSeconds*time.Second, "/healthz fails when a watch loop made no progress for this long")
+	flag.StringVar(&cfg.statusSocket, "statusSocket", defaultStatusSocket, "unix socket to serve the status API on, derived from -netns by default, empty to disable")
+	flag.Var(&cfg.ifaces, "iface", "interface (name or IP) to use for inter-host communication, may be repeated and is tried in order")
+	flag.Var(&cfg.ifaceRegexes, "iface-regex", "regex matching the name or IP of the interface to use, may be repeated and is tried in order")
+	flag.StringVar(&cfg.ifaceCanReach, "iface-can-reach", "", "use the interface the kernel would route through to reach this IP")
+	flag.StringVar(&cfg.publicIP, "public-ip", "", "IP accessible by other nodes for inter-host communication, e.g. the NAT address")
+	flag.StringVar(&cfg.publicIPURL, "public-ip-url", "", "URL of an echo service or metadata endpoint returning this node's public IP, used when -public-ip is not set")
 	flag.Parse()
 
+	statusSocketSet := false
+	flag.Visit(func(f *flag.Flag) {
+		statusSocketSet = statusSocketSet || f.Name == "statusSocket"
+	})
+	if !statusSocketSet {
+		cfg.statusSocket = statusSocketPath(cfg.netns)
+	}
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 
-	extIface, err := lookupExtIface()
+	networks, err := loadNetworks(cfg.networksFile)
 	if err != nil {
-		panic(fmt.Sprintf("lookupExtIface err: %v", err))
+		panic(fmt.Sprintf("load networks err: %v", err))
 	}
 
-	devAttrs := vxlanDeviceAttrs{
-		vni:       defaultVNI,
-		name:      fmt.Sprintf("vxlan.%v", defaultVNI),
-		vtepIndex: extIface.Iface.Index,
-		vtepAddr:  extIface.IfaceAddr,
-		vtepPort:  0,
-		gbp:       false,
+	ns, err := openNetns(cfg.netns)
+	if err != nil {
+		panic(fmt.Sprintf("open netns %q err: %v", cfg.netns, err))
 	}
 
-	dev, err := newVxlanDevice(&devAttrs)
+	nlh, err := newNetlinkHandle(ns)
 	if err != nil {
-		panic(fmt.Sprintf("newVXLANDevice err: %v", err))
+		panic(fmt.Sprintf("new netlink handle err: %v", err))
 	}
-	dev.directRouting = false
 
-	publicIP := FromIP(extIface.ExtAddr)
-	snIP := FromIP(net.ParseIP(fmt.Sprintf(subNetworkTpl, 1+rand.Intn(254))))
-	sn := IP4Net{
-		IP:        snIP,
-		PrefixLen: 24,
+	extIface, err := lookupExtIface(nlh, cfg)
+	if err != nil {
+		panic(fmt.Sprintf("lookupExtIface err: %v", err))
 	}
-	attrs := Attrs{
-		PublicIP:     publicIP,
-		Subnet:       sn,
-		HardwareAddr: dev.link.HardwareAddr,
+
+	var statusListener net.Listener
+	if cfg.statusSocket != "" {
+		if statusListener, err = listenStatus(cfg.statusSocket); err != nil {
+			panic(err.Error())
+		}
 	}
 
 	ctx := context.Background()
 
-	sm := newManager(cfg)
-	if err := sm.createSubnet(ctx, sn, attrs); err != nil {
-		panic(fmt.Errorf("create subnet fail: %v", err))
+	var nets []*network
+	for _, nc := range networks {
+		n, err := newNetwork(ctx, cfg, nc, ns, nlh, extIface)
+		if err != nil {
+			panic(fmt.Sprintf("network %s: %v", nc.Name, err))
+		}
+		n.run(ctx, ns)
+		nets = append(nets, n)
 	}
 
-	logrus.Infof("create subnet: %v, net mask: %v", sn.IP.ToIP(), sn.PrefixLen)
+	go watchExtIface(ctx, ns, nlh, cfg, extIface, nets)
 
-	go handleSubnets(ctx, sn, &sm, dev)
+	if cfg.httpAddr != "" {
+		go serveHTTP(cfg.httpAddr, nets, cfg.healthTimeout)
+	}
 
-	if err := dev.configure(fmt.Sprintf("%v/32", snIP.ToIP())); err != nil {
-		panic(fmt.Errorf("failed to configure interface %s: %s", dev.link.Attrs().Name, err))
+	if statusListener != nil {
+		go serveStatus(statusListener, cfg, nets)
 	}
 
-	go setupAndEnsureIPTables(forwardRules(vxlanNetwork), iptablesResyncSeconds)
 	logrus.Infof("MTU: %v", extIface.Iface.MTU-encapOverhead)
-	logrus.Infof("VXLan HardwareAddr: %v", dev.link.HardwareAddr)
 	logrus.Info("Running backend.")
 	<-sigs
 	logrus.Info("shutdownHandler sent cancel signal...")
@@ -98,21 +171,53 @@ func main() {
 type externalInterface struct {
 	Iface     *net.Interface
 	IfaceAddr net.IP
+	IfaceNet  *net.IPNet
 	ExtAddr   net.IP
 }
 
-func lookupExtIface() (*externalInterface, error) {
+func lookupExtIface(nlh netlinkHandle, cfg config) (*externalInterface, error) {
 	var iface *net.Interface
 	var ifaceAddr net.IP
 	var err error
 
-	logrus.Info("Determining IP address of default interface")
-	if iface, err = getDefaultGatewayIface(); err != nil {
-		return nil, fmt.Errorf("failed to get default interface: %s", err)
+	switch {
+	case len(cfg.ifaces) > 0:
+		for _, s := range cfg.ifaces {
+			if iface, ifaceAddr, err = lookupIface(nlh, s); err == nil {
+				break
+			}
+			logrus.Warningf("Interface %s not usable: %v", s, err)
+		}
+		if iface == nil {
+			return nil, fmt.Errorf("none of the interfaces %v is usable", []string(cfg.ifaces))
+		}
+
+	case len(cfg.ifaceRegexes) > 0:
+		for _, expr := range cfg.ifaceRegexes {
+			if iface, ifaceAddr, err = lookupIfaceRegex(nlh, expr); err == nil {
+				break
+			}
+			logrus.Warningf("No interface matches %s: %v", expr, err)
+		}
+		if iface == nil {
+			return nil, fmt.Errorf("no interface matches %v", []string(cfg.ifaceRegexes))
+		}
+
+	case cfg.ifaceCanReach != "":
+		logrus.Infof("Determining interface that can reach %s", cfg.ifaceCanReach)
+		if iface, ifaceAddr, err = lookupIfaceCanReach(nlh, cfg.ifaceCanReach); err != nil {
+			return nil, fmt.Errorf("failed to find interface that can reach %s: %v", cfg.ifaceCanReach, err)
+		}
+
+	default:
+		logrus.Info("Determining IP address of default interface")
+		if iface, err = getDefaultGatewayIface(nlh); err != nil {
+			return nil, fmt.Errorf("failed to get default interface: %s", err)
+		}
 	}
 
 	if ifaceAddr == nil {
-		ifaceAddr, err = getIfaceIP4Addr(iface)
+		ifaceAddr, err = getIfaceIP4Addr(nlh, iface)
 		if err != nil {
 			return nil, fmt.Errorf("failed to find IPv4 address for interface %s", iface.Name)
 		}
@@ -125,6 +230,18 @@ func lookupExtIface() (*externalInterface, error) {
 	}
 
 	var extAddr net.IP
+	if cfg.publicIP != "" {
+		if extAddr = net.ParseIP(cfg.publicIP).To4(); extAddr == nil {
+			return nil, fmt.Errorf("invalid public IP %q", cfg.publicIP)
+		}
+		logrus.Infof("Using %s as external address", extAddr)
+	} else if cfg.publicIPURL != "" {
+		if extAddr, err = discoverPublicIP(cfg.publicIPURL); err != nil {
+			return nil, fmt.Errorf("failed to discover public IP: %v", err)
+		}
+		logrus.Infof("Discovered external address %s", extAddr)
+	}
+
 	if extAddr == nil {
 		logrus.Infof("Defaulting external address to interface address (%s)", ifaceAddr)
 		extAddr = ifaceAddr
@@ -133,12 +250,100 @@ func lookupExtIface() (*externalInterface, error) {
 	return &externalInterface{
 		Iface:     iface,
 		IfaceAddr: ifaceAddr,
+		IfaceNet:  getIfaceNet(nlh, iface, ifaceAddr),
 		ExtAddr:   extAddr,
 	}, nil
 }
 
-func getDefaultGatewayIface() (*net.Interface, error) {
-	routes, err := netlink.RouteList(nil, syscall.AF_INET)
+// lookupIface finds an interface given either its name or one of its IPv4
+// addresses.
+func lookupIface(nlh netlinkHandle, s string) (*net.Interface, net.IP, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		links, err := nlh.LinkList()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, link := range links {
+			addrs, err := nlh.AddrList(link, syscall.AF_INET)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, addr := range addrs {
+				if addr.IP.Equal(ip) {
+					return linkToInterface(link), addr.IP, nil
+				}
+			}
+		}
+
+		return nil, nil, fmt.Errorf("no interface with address %s", ip)
+	}
+
+	link, err := nlh.LinkByName(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return linkToInterface(link), nil, nil
+}
+
+// lookupIfaceRegex finds the first interface whose name or one of whose IPv4
+// addresses matches expr.
+func lookupIfaceRegex(nlh netlinkHandle, expr string) (*net.Interface, net.IP, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	links, err := nlh.LinkList()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, link := range links {
+		addrs, err := nlh.AddrList(link, syscall.AF_INET)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, addr := range addrs {
+			if re.MatchString(addr.IP.String()) {
+				return linkToInterface(link), addr.IP, nil
+			}
+		}
+
+		if re.MatchString(link.Attrs().Name) {
+			return linkToInterface(link), nil, nil
+		}
+	}
+
+	return nil, nil, errors.New("no match")
+}
+
+// lookupIfaceCanReach finds the interface the kernel would route through to
+// reach s, along with the source address it would use.
+func lookupIfaceCanReach(nlh netlinkHandle, s string) (*net.Interface, net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, nil, fmt.Errorf("invalid IP %q", s)
+	}
+
+	routes, err := nlh.RouteGet(ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(routes) == 0 || routes[0].LinkIndex <= 0 {
+		return nil, nil, errors.New("no route")
+	}
+
+	link, err := nlh.LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	return linkToInterface(link), routes[0].Src, nil
+}
+
+func getDefaultGatewayIface(nlh netlinkHandle) (*net.Interface, error) {
+	routes, err := nlh.RouteList(nil, syscall.AF_INET)
 	if err != nil {
 		return nil, err
 	}
@@ -148,25 +353,44 @@ func getDefaultGatewayIface() (*net.Interface, error) {
 			if route.LinkIndex <= 0 {
 				return nil, errors.New("Found default route but could not determine interface")
 			}
-			return net.InterfaceByIndex(route.LinkIndex)
+			link, err := nlh.LinkByIndex(route.LinkIndex)
+			if err != nil {
+				return nil, err
+			}
+			return linkToInterface(link), nil
 		}
 	}
 
 	return nil, errors.New("Unable to find default route")
 }
 
-func getIfaceAddrs(iface *net.Interface) ([]netlink.Addr, error) {
+func getIfaceAddrs(nlh netlinkHandle, iface *net.Interface) ([]netlink.Addr, error) {
 	link := &netlink.Device{
-		netlink.LinkAttrs{
+		LinkAttrs: netlink.LinkAttrs{
 			Index: iface.Index,
 		},
 	}
 
-	return netlink.AddrList(link, syscall.AF_INET)
+	return nlh.AddrList(link, syscall.AF_INET)
+}
+
+// getIfaceNet returns the network of addr on iface, nil if it can't be found.
+func getIfaceNet(nlh netlinkHandle, iface *net.Interface, addr net.IP) *net.IPNet {
+	addrs, err := getIfaceAddrs(nlh, iface)
+	if err != nil {
+		return nil
+	}
+
+	for _, a := range addrs {
+		if a.IP.Equal(addr) {
+			return &net.IPNet{IP: a.IP.Mask(a.Mask), Mask: a.Mask}
+		}
+	}
+	return nil
 }
 
-func getIfaceIP4Addr(iface *net.Interface) (net.IP, error) {
-	addrs, err := getIfaceAddrs(iface)
+func getIfaceIP4Addr(nlh netlinkHandle, iface *net.Interface) (net.IP, error) {
+	addrs, err := getIfaceAddrs(nlh, iface)
 	if err != nil {
 		return nil, err
 	}
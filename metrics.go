@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	peersGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "vxlan",
+		Name:      "peers",
+		Help:      "Number of known remote peers.",
+	}, []string{"network"})
+
+	programmedEntriesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "vxlan",
+		Name:      "programmed_entries",
+		Help:      "Number of programmed route, arp and fdb entries.",
+	}, []string{"network", "kind"})
+
+	leaseExpiryGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "vxlan",
+		Name:      "lease_expiry_timestamp_seconds",
+		Help:      "Unix time at which our subnet lease expires.",
+	}, []string{"network"})
+
+	subnetEventOpsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vxlan",
+		Name:      "subnet_event_operations_total",
+		Help:      "Operations performed while handling subnet events, by result.",
+	}, []string{"network", "operation", "result"})
+
+	etcdWatchErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vxlan",
+		Name:      "etcd_watch_errors_total",
+		Help:      "Errors returned while watching subnets in etcd.",
+	}, []string{"network"})
+
+	leaseRenewalFailuresCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vxlan",
+		Name:      "lease_renewal_failures_total",
+		Help:      "Failed attempts to renew our subnet lease.",
+	}, []string{"network"})
+
+	iptablesMissingRulesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "vxlan",
+		Name:      "iptables_missing_rules_resyncs_total",
+		Help:      "iptables resyncs that found missing rules and recreated them.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		peersGauge,
+		programmedEntriesGauge,
+		leaseExpiryGauge,
+		subnetEventOpsCounter,
+		etcdWatchErrorsCounter,
+		leaseRenewalFailuresCounter,
+		iptablesMissingRulesCounter,
+	)
+}
+
+// observeOp counts the outcome of a subnet event operation such as AddARP.
+func observeOp(network, op string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	subnetEventOpsCounter.WithLabelValues(network, op, result).Inc()
+}
+
+func serveHTTP(addr string, networks []*network, healthTimeout time.Duration) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthzHandler(networks, healthTimeout))
+	mux.Handle("/readyz", readyzHandler(networks))
+
+	logrus.Infof("Serving metrics and health checks on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.Errorf("HTTP server exited: %v", err)
+	}
+}
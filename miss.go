@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// handleMisses answers the L2 and L3 miss notifications the kernel sends for
+// the device from the peer table, like flannel's vxlan v1 backend. Entries are
+// installed as reachable so that the kernel ages out the ones not in use.
+// The device is not ready while the subscription is down.
+func (dev *vxlanDevice) handleMisses(ctx context.Context, ns netns.NsHandle) {
+	resubscribe(ctx, fmt.Sprintf("[%s] Answering misses", dev.network), func(bool) error {
+		done := make(chan struct{})
+		var ch chan netlink.NeighUpdate
+		defer func() {
+			dev.setMissesWatched(false)
+			close(done)
+			// let the subscription goroutine exit if it is blocked on a send
+			if ch != nil {
+				go func() {
+					for range ch {
+					}
+				}()
+			}
+		}()
+
+		var neighErr error
+		nch := make(chan netlink.NeighUpdate)
+		if err := netlink.NeighSubscribeWithOptions(nch, done, netlink.NeighSubscribeOptions{
+			Namespace:     &ns,
+			ErrorCallback: func(err error) { neighErr = err },
+		}); err != nil {
+			return fmt.Errorf("failed to subscribe to neighbor updates: %v", err)
+		}
+		ch = nch
+		// misses lost while unsubscribed are raised again by the next packet
+		dev.setMissesWatched(true)
+
+		for {
+			var u netlink.NeighUpdate
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return nil
+			case u, ok = <-ch:
+				if !ok {
+					ch = nil
+					return fmt.Errorf("neighbor update subscription closed: %v", neighErr)
+				}
+			}
+
+			if u.Type != syscall.RTM_GETNEIGH || u.LinkIndex != dev.vxlanLink().Index {
+				continue
+			}
+
+			switch {
+			case len(u.IP) > 0 && len(u.HardwareAddr) == 0:
+				dev.answerL3Miss(u.IP)
+			case len(u.IP) == 0 && len(u.HardwareAddr) > 0:
+				dev.answerL2Miss(u.HardwareAddr)
+			default:
+				logrus.Debugf("[%s] Ignoring neighbor miss: %v", dev.network, u.Neigh)
+			}
+		}
+	})
+}
+
+func (dev *vxlanDevice) setMissesWatched(watched bool) {
+	dev.mu.Lock()
+	dev.missesWatched = watched
+	dev.mu.Unlock()
+}
+
+// answerL3Miss installs an ARP entry for ip pointing at the VTEP MAC of the
+// peer whose subnet contains it.
+func (dev *vxlanDevice) answerL3Miss(ip net.IP) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	for sn, p := range dev.peers {
+		if !sn.ToIPNet().Contains(ip) {
+			continue
+		}
+
+		logrus.Debugf("L3 miss for %v: answering %v", ip, p.attrs.HardwareAddr)
+		err := dev.nlh.NeighSet(&netlink.Neigh{
+			LinkIndex:    dev.link.Index,
+			State:        netlink.NUD_REACHABLE,
+			Type:         syscall.RTN_UNICAST,
+			IP:           ip,
+			HardwareAddr: p.attrs.HardwareAddr,
+		})
+		observeOp(dev.network, "L3Miss", err)
+		if err != nil {
+			logrus.Errorf("Failed to answer L3 miss for %v: %v", ip, err)
+		}
+		return
+	}
+
+	logrus.Debugf("L3 miss for %v: no peer", ip)
+}
+
+// answerL2Miss installs an FDB entry for the VTEP MAC mac pointing at the
+// peer it belongs to.
+func (dev *vxlanDevice) answerL2Miss(mac net.HardwareAddr) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	for _, p := range dev.peers {
+		if !bytes.Equal(p.attrs.HardwareAddr, mac) {
+			continue
+		}
+
+		vtepIP := dev.peerVtepIP(p.attrs)
+		logrus.Debugf("L2 miss for %v: answering %v", mac, vtepIP)
+		err := dev.nlh.NeighSet(&netlink.Neigh{
+			LinkIndex:    dev.link.Index,
+			State:        netlink.NUD_REACHABLE,
+			Family:       syscall.AF_BRIDGE,
+			Flags:        netlink.NTF_SELF,
+			IP:           vtepIP,
+			HardwareAddr: mac,
+		})
+		observeOp(dev.network, "L2Miss", err)
+		if err != nil {
+			logrus.Errorf("Failed to answer L2 miss for %v: %v", mac, err)
+		}
+		return
+	}
+
+	logrus.Debugf("L2 miss for %v: no peer", mac)
+}
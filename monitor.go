@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// extIfaceSettleTime lets a burst of address and route updates (e.g. a DHCP
+// renewal) finish before the external interface is looked up again.
+const extIfaceSettleTime = 2 * time.Second
+
+// Netlink subscriptions end when the kernel drops updates the socket could
+// not buffer (ENOBUFS). They are reopened after a delay that doubles from
+// minResubscribeDelay up to maxResubscribeDelay while they keep failing.
+const (
+	minResubscribeDelay = time.Second
+	maxResubscribeDelay = 30 * time.Second
+)
+
+// resubscribe calls follow until ctx is done. follow subscribes to netlink
+// updates and handles them until the subscription fails or is closed; it is
+// then called again with resync set, as updates may have been missed.
+func resubscribe(ctx context.Context, what string, follow func(resync bool) error) {
+	delay := minResubscribeDelay
+	for resync := false; ; resync = true {
+		start := time.Now()
+		err := follow(resync)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > maxResubscribeDelay {
+			delay = minResubscribeDelay
+		}
+
+		logrus.Errorf("%s failed, resubscribing in %v: %v", what, delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxResubscribeDelay {
+			delay = maxResubscribeDelay
+		}
+	}
+}
+
+// watchExtIface follows address and default route changes in ns and moves
+// every network onto the new external interface when it changes.
+func watchExtIface(ctx context.Context, ns netns.NsHandle, nlh netlinkHandle, cfg config, extIface *externalInterface, networks []*network) {
+	check := func() {
+		newIface, err := lookupExtIface(nlh, cfg)
+		if err != nil {
+			logrus.Errorf("Failed to look up external interface after a change: %v", err)
+			return
+		}
+
+		if newIface.Iface.Index == extIface.Iface.Index &&
+			newIface.IfaceAddr.Equal(extIface.IfaceAddr) &&
+			newIface.ExtAddr.Equal(extIface.ExtAddr) {
+			return
+		}
+
+		logrus.Infof("External interface changed from %s (%s, public %s) to %s (%s, public %s)",
+			extIface.Iface.Name, extIface.IfaceAddr, extIface.ExtAddr,
+			newIface.Iface.Name, newIface.IfaceAddr, newIface.ExtAddr)
+
+		for _, n := range networks {
+			if err := n.setExtIface(ctx, newIface); err != nil {
+				logrus.Errorf("[%s] Failed to move to new external interface: %v", n.cfg.Name, err)
+			}
+		}
+		extIface = newIface
+	}
+
+	resubscribe(ctx, "Watching the external interface", func(resync bool) error {
+		done := make(chan struct{})
+		var addrCh chan netlink.AddrUpdate
+		var routeCh chan netlink.RouteUpdate
+		defer func() {
+			close(done)
+			// let the subscription goroutines exit if they are blocked on a send
+			if addrCh != nil {
+				go func() {
+					for range addrCh {
+					}
+				}()
+			}
+			if routeCh != nil {
+				go func() {
+					for range routeCh {
+					}
+				}()
+			}
+		}()
+
+		// the callbacks run on the subscription goroutines before they close
+		// their channel, so the errors can be read once it is closed
+		var addrErr, routeErr error
+		ch := make(chan netlink.AddrUpdate)
+		if err := netlink.AddrSubscribeWithOptions(ch, done, netlink.AddrSubscribeOptions{
+			Namespace:     &ns,
+			ErrorCallback: func(err error) { addrErr = err },
+		}); err != nil {
+			return fmt.Errorf("failed to subscribe to address updates: %v", err)
+		}
+		addrCh = ch
+
+		rch := make(chan netlink.RouteUpdate)
+		if err := netlink.RouteSubscribeWithOptions(rch, done, netlink.RouteSubscribeOptions{
+			Namespace:     &ns,
+			ErrorCallback: func(err error) { routeErr = err },
+		}); err != nil {
+			return fmt.Errorf("failed to subscribe to route updates: %v", err)
+		}
+		routeCh = rch
+
+		if resync {
+			check()
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+
+			case u, ok := <-addrCh:
+				if !ok {
+					addrCh = nil
+					return fmt.Errorf("address update subscription closed: %v", addrErr)
+				}
+				if u.LinkIndex != extIface.Iface.Index {
+					continue
+				}
+
+			case u, ok := <-routeCh:
+				if !ok {
+					routeCh = nil
+					return fmt.Errorf("route update subscription closed: %v", routeErr)
+				}
+				if u.Dst != nil && u.Dst.String() != "0.0.0.0/0" {
+					continue
+				}
+			}
+
+			time.Sleep(extIfaceSettleTime)
+			drainUpdates(addrCh, routeCh)
+			check()
+		}
+	})
+}
+
+func drainUpdates(addrCh chan netlink.AddrUpdate, routeCh chan netlink.RouteUpdate) {
+	for {
+		select {
+		case _, ok := <-addrCh:
+			if !ok {
+				return
+			}
+		case _, ok := <-routeCh:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// watchLink follows updates of the network's device and restores it
+// when it was deleted, downed or replaced behind our back.
+func (n *network) watchLink(ctx context.Context, ns netns.NsHandle) {
+	name := n.overlay().linkName()
+	check := func() {
+		// look at the current state rather than the update, which may be
+		// stale or caused by our own recreation
+		if n.overlay().linkIntact() {
+			return
+		}
+
+		logrus.Warningf("[%s] %s was deleted or brought down, recreating it", n.cfg.Name, name)
+		if err := n.restoreDevice(ctx); err != nil {
+			logrus.Errorf("[%s] Failed to restore %s: %v", n.cfg.Name, name, err)
+		}
+	}
+
+	resubscribe(ctx, fmt.Sprintf("[%s] Watching %s", n.cfg.Name, name), func(resync bool) error {
+		done := make(chan struct{})
+		var linkCh chan netlink.LinkUpdate
+		defer func() {
+			close(done)
+			// let the subscription goroutine exit if it is blocked on a send
+			if linkCh != nil {
+				go func() {
+					for range linkCh {
+					}
+				}()
+			}
+		}()
+
+		var linkErr error
+		ch := make(chan netlink.LinkUpdate)
+		if err := netlink.LinkSubscribeWithOptions(ch, done, netlink.LinkSubscribeOptions{
+			Namespace:     &ns,
+			ErrorCallback: func(err error) { linkErr = err },
+		}); err != nil {
+			return fmt.Errorf("failed to subscribe to link updates: %v", err)
+		}
+		linkCh = ch
+
+		if resync {
+			check()
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case u, ok := <-linkCh:
+				if !ok {
+					linkCh = nil
+					return fmt.Errorf("link update subscription closed: %v", linkErr)
+				}
+				if u.Attrs().Name != name {
+					continue
+				}
+			}
+			check()
+		}
+	})
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestResubscribeResyncsAfterFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var resyncs []bool
+	resubscribe(ctx, "test", func(resync bool) error {
+		resyncs = append(resyncs, resync)
+		if len(resyncs) == 2 {
+			cancel()
+			return nil
+		}
+		return errors.New("subscription closed")
+	})
+
+	if want := []bool{false, true}; !reflect.DeepEqual(resyncs, want) {
+		t.Fatalf("got resyncs %v, want %v", resyncs, want)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+)
+
+// netlinkHandle is the subset of netlink operations used to program the
+// vxlan device, its bridge, neighbors, routes and IPsec SAs. *nsHandle satisfies it.
+type netlinkHandle interface {
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	VxlanChange(vxlan *netlink.Vxlan) error
+	LinkByName(name string) (netlink.Link, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+	LinkSetUp(link netlink.Link) error
+	LinkSetMasterByIndex(link netlink.Link, masterIndex int) error
+	NeighSet(neigh *netlink.Neigh) error
+	NeighAppend(neigh *netlink.Neigh) error
+	NeighDel(neigh *netlink.Neigh) error
+	NeighList(linkIndex, family int) ([]netlink.Neigh, error)
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	RouteGet(destination net.IP) ([]netlink.Route, error)
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+	XfrmStateAdd(state *netlink.XfrmState) error
+	XfrmStateDel(state *netlink.XfrmState) error
+	XfrmStateList(family int) ([]netlink.XfrmState, error)
+	XfrmPolicyAdd(policy *netlink.XfrmPolicy) error
+	XfrmPolicyDel(policy *netlink.XfrmPolicy) error
+}
+
+var _ netlinkHandle = &nsHandle{}
+
+// nsHandle is a netlink handle operating inside ns.
+type nsHandle struct {
+	*netlink.Handle
+	ns netns.NsHandle
+}
+
+// VxlanChange sets the TTL, TOS, learning, ageing and limit of an existing
+// vxlan device. LinkModify can't be used for that: it sends all attributes
+// of the link and the kernel refuses to change most of them, even to their
+// current value. Zero ageing and limit are left alone.
+func (h *nsHandle) VxlanChange(vxlan *netlink.Vxlan) error {
+	s, err := nl.GetNetlinkSocketAt(h.ns, netns.None(), syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK)
+	req.Sockets = map[int]*nl.SocketHandle{syscall.NETLINK_ROUTE: {Socket: s}}
+
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(vxlan.Index)
+	req.AddData(msg)
+
+	learning := uint8(0)
+	if vxlan.Learning {
+		learning = 1
+	}
+
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	linkInfo.AddRtAttr(nl.IFLA_INFO_KIND, nl.NonZeroTerminated(vxlan.Type()))
+	data := linkInfo.AddRtAttr(nl.IFLA_INFO_DATA, nil)
+	data.AddRtAttr(nl.IFLA_VXLAN_TTL, nl.Uint8Attr(uint8(vxlan.TTL)))
+	data.AddRtAttr(nl.IFLA_VXLAN_TOS, nl.Uint8Attr(uint8(vxlan.TOS)))
+	data.AddRtAttr(nl.IFLA_VXLAN_LEARNING, nl.Uint8Attr(learning))
+	if vxlan.Age > 0 {
+		data.AddRtAttr(nl.IFLA_VXLAN_AGEING, nl.Uint32Attr(uint32(vxlan.Age)))
+	}
+	if vxlan.Limit > 0 {
+		data.AddRtAttr(nl.IFLA_VXLAN_LIMIT, nl.Uint32Attr(uint32(vxlan.Limit)))
+	}
+	req.AddData(linkInfo)
+
+	_, err = req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// linkToInterface converts netlink link attributes into a net.Interface,
+// which works for links in any network namespace.
+func linkToInterface(link netlink.Link) *net.Interface {
+	attrs := link.Attrs()
+	return &net.Interface{
+		Index:        attrs.Index,
+		MTU:          attrs.MTU,
+		Name:         attrs.Name,
+		HardwareAddr: attrs.HardwareAddr,
+		Flags:        attrs.Flags,
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// fakeNetlink is an in-memory netlinkHandle. It keeps the links, neighbors,
+// routes, addresses and xfrm entries programmed through it and records every
+// change as "<op> <what>", e.g. "NeighSet fdb 192.168.1.2".
+type fakeNetlink struct {
+	links     map[int]netlink.Link
+	nextIndex int
+	neighs    map[string]netlink.Neigh
+	routes    map[string]netlink.Route
+	addrs     map[int][]netlink.Addr
+	states    map[string]*netlink.XfrmState
+	policies  map[string]*netlink.XfrmPolicy
+
+	calls []string
+	// fail makes the changes whose record starts with a key fail
+	fail map[string]error
+}
+
+func newFakeNetlink() *fakeNetlink {
+	return &fakeNetlink{
+		links:     map[int]netlink.Link{},
+		nextIndex: 10,
+		neighs:    map[string]netlink.Neigh{},
+		routes:    map[string]netlink.Route{},
+		addrs:     map[int][]netlink.Addr{},
+		states:    map[string]*netlink.XfrmState{},
+		policies:  map[string]*netlink.XfrmPolicy{},
+		fail:      map[string]error{},
+	}
+}
+
+// record notes the change and returns the error injected for it, if any.
+func (f *fakeNetlink) record(op string, args ...interface{}) error {
+	call := strings.TrimSpace(op + " " + fmt.Sprintln(args...))
+	f.calls = append(f.calls, call)
+	for prefix, err := range f.fail {
+		if strings.HasPrefix(call, prefix) {
+			return err
+		}
+	}
+	return nil
+}
+
+// reset forgets the recorded calls.
+func (f *fakeNetlink) reset() {
+	f.calls = nil
+}
+
+func (f *fakeNetlink) LinkAdd(link netlink.Link) error {
+	if err := f.record("LinkAdd", link.Attrs().Name); err != nil {
+		return err
+	}
+	for _, l := range f.links {
+		if l.Attrs().Name == link.Attrs().Name {
+			return syscall.EEXIST
+		}
+	}
+	link.Attrs().Index = f.nextIndex
+	f.nextIndex++
+	f.links[link.Attrs().Index] = copyLink(link)
+	return nil
+}
+
+func copyLink(link netlink.Link) netlink.Link {
+	switch l := link.(type) {
+	case *netlink.Vxlan:
+		c := *l
+		return &c
+	case *netlink.Bridge:
+		c := *l
+		return &c
+	case *netlink.Wireguard:
+		c := *l
+		return &c
+	}
+	c := *link.Attrs()
+	return &netlink.Dummy{LinkAttrs: c}
+}
+
+func (f *fakeNetlink) LinkDel(link netlink.Link) error {
+	if err := f.record("LinkDel", link.Attrs().Name); err != nil {
+		return err
+	}
+	if _, ok := f.links[link.Attrs().Index]; !ok {
+		return syscall.ENODEV
+	}
+	delete(f.links, link.Attrs().Index)
+	return nil
+}
+
+func (f *fakeNetlink) LinkSetMTU(link netlink.Link, mtu int) error {
+	if err := f.record("LinkSetMTU", link.Attrs().Name, mtu); err != nil {
+		return err
+	}
+	l, ok := f.links[link.Attrs().Index]
+	if !ok {
+		return syscall.ENODEV
+	}
+	l.Attrs().MTU = mtu
+	return nil
+}
+
+func (f *fakeNetlink) VxlanChange(vxlan *netlink.Vxlan) error {
+	if err := f.record("VxlanChange", vxlan.Name); err != nil {
+		return err
+	}
+	l, ok := f.links[vxlan.Index].(*netlink.Vxlan)
+	if !ok {
+		return syscall.ENODEV
+	}
+	l.TTL, l.TOS, l.Learning = vxlan.TTL, vxlan.TOS, vxlan.Learning
+	if vxlan.Age > 0 {
+		l.Age = vxlan.Age
+	}
+	if vxlan.Limit > 0 {
+		l.Limit = vxlan.Limit
+	}
+	return nil
+}
+
+func (f *fakeNetlink) LinkByName(name string) (netlink.Link, error) {
+	for _, l := range f.links {
+		if l.Attrs().Name == name {
+			return copyLink(l), nil
+		}
+	}
+	return nil, netlink.LinkNotFoundError{}
+}
+
+func (f *fakeNetlink) LinkByIndex(index int) (netlink.Link, error) {
+	if l, ok := f.links[index]; ok {
+		return copyLink(l), nil
+	}
+	return nil, netlink.LinkNotFoundError{}
+}
+
+func (f *fakeNetlink) LinkList() ([]netlink.Link, error) {
+	var links []netlink.Link
+	for _, l := range f.links {
+		links = append(links, copyLink(l))
+	}
+	return links, nil
+}
+
+func (f *fakeNetlink) LinkSetUp(link netlink.Link) error {
+	if err := f.record("LinkSetUp", link.Attrs().Name); err != nil {
+		return err
+	}
+	l, ok := f.links[link.Attrs().Index]
+	if !ok {
+		return syscall.ENODEV
+	}
+	l.Attrs().Flags |= net.FlagUp
+	return nil
+}
+
+func (f *fakeNetlink) LinkSetMasterByIndex(link netlink.Link, masterIndex int) error {
+	if err := f.record("LinkSetMasterByIndex", link.Attrs().Name, masterIndex); err != nil {
+		return err
+	}
+	l, ok := f.links[link.Attrs().Index]
+	if !ok {
+		return syscall.ENODEV
+	}
+	l.Attrs().MasterIndex = masterIndex
+	return nil
+}
+
+// neighKind tells the ARP entries, FDB entries and flood entries apart.
+func neighKind(n *netlink.Neigh) string {
+	switch {
+	case n.Family != syscall.AF_BRIDGE:
+		return "arp"
+	case n.HardwareAddr.String() == floodMAC.String():
+		return "flood"
+	}
+	return "fdb"
+}
+
+func neighKey(n *netlink.Neigh) string {
+	key := fmt.Sprintf("%s %d %s", neighKind(n), n.LinkIndex, n.IP)
+	if neighKind(n) == "flood" {
+		return key
+	}
+	// the kernel keys FDB entries by MAC and ARP entries by IP
+	if neighKind(n) == "fdb" {
+		key = fmt.Sprintf("fdb %d %s", n.LinkIndex, n.HardwareAddr)
+	}
+	return key
+}
+
+func (f *fakeNetlink) NeighSet(neigh *netlink.Neigh) error {
+	if err := f.record("NeighSet", neighKind(neigh), neigh.IP); err != nil {
+		return err
+	}
+	f.neighs[neighKey(neigh)] = *neigh
+	return nil
+}
+
+func (f *fakeNetlink) NeighAppend(neigh *netlink.Neigh) error {
+	if err := f.record("NeighAppend", neighKind(neigh), neigh.IP); err != nil {
+		return err
+	}
+	if _, ok := f.neighs[neighKey(neigh)]; ok {
+		return syscall.EEXIST
+	}
+	f.neighs[neighKey(neigh)] = *neigh
+	return nil
+}
+
+func (f *fakeNetlink) NeighDel(neigh *netlink.Neigh) error {
+	if err := f.record("NeighDel", neighKind(neigh), neigh.IP); err != nil {
+		return err
+	}
+	if _, ok := f.neighs[neighKey(neigh)]; !ok {
+		return syscall.ENOENT
+	}
+	delete(f.neighs, neighKey(neigh))
+	return nil
+}
+
+func (f *fakeNetlink) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	var neighs []netlink.Neigh
+	for _, n := range f.neighs {
+		if (linkIndex == 0 || n.LinkIndex == linkIndex) && (family == 0 || n.Family == family) {
+			neighs = append(neighs, n)
+		}
+	}
+	return neighs, nil
+}
+
+func (f *fakeNetlink) RouteReplace(route *netlink.Route) error {
+	if err := f.record("RouteReplace", route.Dst); err != nil {
+		return err
+	}
+	f.routes[route.Dst.String()] = *route
+	return nil
+}
+
+func (f *fakeNetlink) RouteDel(route *netlink.Route) error {
+	if err := f.record("RouteDel", route.Dst); err != nil {
+		return err
+	}
+	if _, ok := f.routes[route.Dst.String()]; !ok {
+		return syscall.ESRCH
+	}
+	delete(f.routes, route.Dst.String())
+	return nil
+}
+
+func (f *fakeNetlink) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	var routes []netlink.Route
+	for _, r := range f.routes {
+		if link == nil || r.LinkIndex == link.Attrs().Index {
+			routes = append(routes, r)
+		}
+	}
+	return routes, nil
+}
+
+func (f *fakeNetlink) RouteGet(destination net.IP) ([]netlink.Route, error) {
+	for _, r := range f.routes {
+		if r.Dst != nil && r.Dst.Contains(destination) {
+			return []netlink.Route{r}, nil
+		}
+	}
+	return nil, syscall.ENETUNREACH
+}
+
+func (f *fakeNetlink) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return f.addrs[link.Attrs().Index], nil
+}
+
+func (f *fakeNetlink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	if err := f.record("AddrAdd", link.Attrs().Name, addr.IPNet); err != nil {
+		return err
+	}
+	f.addrs[link.Attrs().Index] = append(f.addrs[link.Attrs().Index], *addr)
+	return nil
+}
+
+func (f *fakeNetlink) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	if err := f.record("AddrDel", link.Attrs().Name, addr.IPNet); err != nil {
+		return err
+	}
+	addrs := f.addrs[link.Attrs().Index]
+	for i, a := range addrs {
+		if a.Equal(*addr) {
+			f.addrs[link.Attrs().Index] = append(addrs[:i], addrs[i+1:]...)
+			return nil
+		}
+	}
+	return syscall.EADDRNOTAVAIL
+}
+
+func stateKey(s *netlink.XfrmState) string {
+	return fmt.Sprintf("%s %s %#x", s.Src, s.Dst, s.Spi)
+}
+
+func (f *fakeNetlink) XfrmStateAdd(state *netlink.XfrmState) error {
+	if err := f.record("XfrmStateAdd", state.Src, state.Dst); err != nil {
+		return err
+	}
+	if state.ESN && state.ReplayWindow == 0 {
+		// refused by netlink before it reaches the kernel
+		return fmt.Errorf("ESN flag set without ReplayWindow")
+	}
+	if _, ok := f.states[stateKey(state)]; ok {
+		return syscall.EEXIST
+	}
+	c := *state
+	f.states[stateKey(state)] = &c
+	return nil
+}
+
+func (f *fakeNetlink) XfrmStateDel(state *netlink.XfrmState) error {
+	if err := f.record("XfrmStateDel", state.Src, state.Dst); err != nil {
+		return err
+	}
+	if _, ok := f.states[stateKey(state)]; !ok {
+		return syscall.ESRCH
+	}
+	delete(f.states, stateKey(state))
+	return nil
+}
+
+func (f *fakeNetlink) XfrmStateList(family int) ([]netlink.XfrmState, error) {
+	var states []netlink.XfrmState
+	for _, s := range f.states {
+		states = append(states, *s)
+	}
+	return states, nil
+}
+
+func policyKey(p *netlink.XfrmPolicy) string {
+	return fmt.Sprintf("%s %s %v", p.Src, p.Dst, p.Dir)
+}
+
+func (f *fakeNetlink) XfrmPolicyAdd(policy *netlink.XfrmPolicy) error {
+	if err := f.record("XfrmPolicyAdd", policy.Src, policy.Dst); err != nil {
+		return err
+	}
+	if _, ok := f.policies[policyKey(policy)]; ok {
+		return syscall.EEXIST
+	}
+	c := *policy
+	f.policies[policyKey(policy)] = &c
+	return nil
+}
+
+func (f *fakeNetlink) XfrmPolicyDel(policy *netlink.XfrmPolicy) error {
+	if err := f.record("XfrmPolicyDel", policy.Src, policy.Dst); err != nil {
+		return err
+	}
+	if _, ok := f.policies[policyKey(policy)]; !ok {
+		return syscall.ENOENT
+	}
+	delete(f.policies, policyKey(policy))
+	return nil
+}
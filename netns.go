@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// openNetns returns a handle to the network namespace given either as a path
+// (e.g. /proc/<pid>/ns/net) or as a name created by `ip netns add`. An empty
+// value means the daemon's own namespace.
+func openNetns(pathOrName string) (netns.NsHandle, error) {
+	if pathOrName == "" {
+		return netns.None(), nil
+	}
+
+	if strings.Contains(pathOrName, "/") {
+		return netns.GetFromPath(pathOrName)
+	}
+	return netns.GetFromName(pathOrName)
+}
+
+// newNetlinkHandle returns a netlink handle operating inside ns.
+func newNetlinkHandle(ns netns.NsHandle) (*nsHandle, error) {
+	nlh, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create netlink handle: %v", err)
+	}
+	return &nsHandle{Handle: nlh, ns: ns}, nil
+}
+
+// enterNetns locks the calling goroutine to its OS thread and switches that
+// thread into ns, so that commands it executes (e.g. iptables) act on ns.
+// The thread is never unlocked; it is discarded when the goroutine exits.
+func enterNetns(ns netns.NsHandle) error {
+	if !ns.IsOpen() {
+		return nil
+	}
+
+	runtime.LockOSThread()
+	return netns.Set(ns)
+}
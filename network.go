@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	// modeUnicast programs static ARP and FDB entries for every peer
+	modeUnicast = "unicast"
+	// modeMulticast floods over an underlay multicast group and lets the
+	// kernel learn neighbors
+	modeMulticast = "multicast"
+	// modeMiss answers the device's L2/L3 miss notifications on demand
+	modeMiss = "miss"
+	// modeFlood replicates broadcast and unknown unicast to every peer
+	// through all-zeros FDB entries and lets the kernel learn the rest
+	modeFlood = "flood"
+	// modeBridge enslaves the device to a bridge holding the gateway
+	// address, making the whole network one flat L2 segment
+	modeBridge = "bridge"
+)
+
+// networkConfig describes one overlay network served by the daemon.
+type networkConfig struct {
+	Name      string `json:"name"`
+	VNI       uint32 `json:"vni"`
+	Network   string `json:"network"`
+	SubnetLen uint   `json:"subnetLen"`
+	Prefix    string `json:"prefix"`
+	MTU       int    `json:"mtu"`
+	Mode      string `json:"mode"`
+	Group     string `json:"group"`
+	Bridge    string `json:"bridge"`
+	// GBP enables Group-Based Policy when set
+	GBP *gbpConfig `json:"gbp"`
+	// UDP settings of the device, zero leaves them to the kernel
+	Port     int  `json:"port"`
+	PortLow  int  `json:"portLow"`
+	PortHigh int  `json:"portHigh"`
+	UDPCSum  bool `json:"udpCsum"`
+	TTL      int  `json:"ttl"`
+	TOS      int  `json:"tos"`
+	// Encryption encrypts the traffic between VTEPs, "ipsec" or empty
+	Encryption string `json:"encryption"`
+	// Backend is "vxlan" (the default) or "wireguard"
+	Backend string `json:"backend"`
+}
+
+func defaultNetworkConfig() networkConfig {
+	return networkConfig{
+		Name:      "default",
+		VNI:       defaultVNI,
+		Network:   defaultNetwork,
+		SubnetLen: defaultSubnetLen,
+		Prefix:    defaultPrefix,
+		Mode:      modeUnicast,
+	}
+}
+
+// loadNetworks reads the list of networks from the JSON file at path. Without
+// a file the daemon serves the single default network.
+func loadNetworks(file string) ([]networkConfig, error) {
+	if file == "" {
+		return []networkConfig{defaultNetworkConfig()}, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var networks []networkConfig
+	if err := json.Unmarshal(data, &networks); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("no networks defined in %s", file)
+	}
+
+	names := map[string]bool{}
+	vnis := map[uint32]bool{}
+	cidrs := map[string]*net.IPNet{}
+	for i := range networks {
+		nc := &networks[i]
+		if nc.Name == "" {
+			return nil, fmt.Errorf("network %d has no name", i)
+		}
+		if names[nc.Name] {
+			return nil, fmt.Errorf("duplicate network name %q", nc.Name)
+		}
+		names[nc.Name] = true
+
+		if nc.VNI == 0 {
+			return nil, fmt.Errorf("network %q has no vni", nc.Name)
+		}
+		if vnis[nc.VNI] {
+			return nil, fmt.Errorf("network %q: duplicate vni %v", nc.Name, nc.VNI)
+		}
+		vnis[nc.VNI] = true
+
+		if nc.SubnetLen == 0 {
+			nc.SubnetLen = defaultSubnetLen
+		}
+		if nc.Prefix == "" {
+			nc.Prefix = path.Join(defaultPrefix, nc.Name)
+		}
+
+		ipn, err := nc.ipNet()
+		if err != nil {
+			return nil, fmt.Errorf("network %q: %v", nc.Name, err)
+		}
+
+		switch nc.Mode {
+		case "":
+			nc.Mode = modeUnicast
+		case modeUnicast, modeMiss, modeFlood:
+		case modeMulticast:
+			if group := net.ParseIP(nc.Group); group == nil || group.To4() == nil || !group.IsMulticast() {
+				return nil, fmt.Errorf("network %q: multicast mode needs an IPv4 multicast group, got %q", nc.Name, nc.Group)
+			}
+		case modeBridge:
+			if nc.Bridge == "" {
+				nc.Bridge = fmt.Sprintf("vxbr.%v", nc.VNI)
+			}
+		default:
+			return nil, fmt.Errorf("network %q: unknown mode %q", nc.Name, nc.Mode)
+		}
+		if nc.GBP != nil {
+			if err := nc.GBP.validate(ipn.ToIPNet()); err != nil {
+				return nil, fmt.Errorf("network %q: %v", nc.Name, err)
+			}
+		}
+		switch nc.Encryption {
+		case "", encryptionIPsec:
+		default:
+			return nil, fmt.Errorf("network %q: unknown encryption %q", nc.Name, nc.Encryption)
+		}
+		if err := nc.validateUDP(); err != nil {
+			return nil, fmt.Errorf("network %q: %v", nc.Name, err)
+		}
+		switch nc.Backend {
+		case "":
+			nc.Backend = backendVxlan
+		case backendVxlan:
+		case backendWireGuard:
+			if err := nc.validateWireGuard(); err != nil {
+				return nil, fmt.Errorf("network %q: %v", nc.Name, err)
+			}
+		default:
+			return nil, fmt.Errorf("network %q: unknown backend %q", nc.Name, nc.Backend)
+		}
+		if nc.SubnetLen <= ipn.PrefixLen || nc.SubnetLen > 30 {
+			return nil, fmt.Errorf("network %q: subnetLen %v does not fit in %s", nc.Name, nc.SubnetLen, nc.Network)
+		}
+
+		// routes and leases of overlapping networks would shadow each other
+		cidr := ipn.ToIPNet()
+		for name, other := range cidrs {
+			if cidr.Contains(other.IP) || other.Contains(cidr.IP) {
+				return nil, fmt.Errorf("network %q: %s overlaps %s of network %q", nc.Name, cidr, other, name)
+			}
+		}
+		cidrs[nc.Name] = cidr
+	}
+
+	return networks, nil
+}
+
+func (nc networkConfig) ipNet() (IP4Net, error) {
+	_, ipn, err := net.ParseCIDR(nc.Network)
+	if err != nil {
+		return IP4Net{}, err
+	}
+	if ipn.IP.To4() == nil {
+		return IP4Net{}, fmt.Errorf("%s is not an IPv4 network", nc.Network)
+	}
+
+	prefixLen, _ := ipn.Mask.Size()
+	return IP4Net{IP: FromIP(ipn.IP), PrefixLen: uint(prefixLen)}, nil
+}
+
+func (nc networkConfig) validateUDP() error {
+	if nc.Port < 0 || nc.Port > 65535 {
+		return fmt.Errorf("invalid port %v", nc.Port)
+	}
+	if nc.PortLow != 0 || nc.PortHigh != 0 {
+		if nc.PortLow <= 0 || nc.PortHigh > 65535 || nc.PortLow > nc.PortHigh {
+			return fmt.Errorf("invalid source port range %v-%v", nc.PortLow, nc.PortHigh)
+		}
+	}
+	if nc.TTL < 0 || nc.TTL > 255 {
+		return fmt.Errorf("invalid ttl %v", nc.TTL)
+	}
+	if nc.TOS < 0 || nc.TOS > 255 {
+		return fmt.Errorf("invalid tos %v", nc.TOS)
+	}
+	return nil
+}
+
+// validateWireGuard rejects the vxlan specific options, WireGuard only has
+// a listen port and routes to peers.
+func (nc networkConfig) validateWireGuard() error {
+	if nc.Mode != modeUnicast {
+		return fmt.Errorf("mode %q needs the vxlan backend", nc.Mode)
+	}
+	if nc.GBP != nil {
+		return fmt.Errorf("gbp needs the vxlan backend")
+	}
+	if nc.Encryption != "" {
+		return fmt.Errorf("the wireguard backend is always encrypted, drop encryption %q", nc.Encryption)
+	}
+	if nc.PortLow != 0 || nc.PortHigh != 0 || nc.UDPCSum || nc.TTL != 0 || nc.TOS != 0 {
+		return fmt.Errorf("only port can be set with the wireguard backend")
+	}
+	return nil
+}
+
+// gateway returns the address every node puts on its bridge in bridge mode:
+// the first host of the network, with the prefix of the whole network.
+func (nc networkConfig) gateway() (string, error) {
+	ipn, err := nc.ipNet()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v/%v", (ipn.IP + 1).ToIP(), ipn.PrefixLen), nil
+}
+
+// randomSubnet picks a random subnet of length subnetLen inside n, skipping
+// the first and the last one.
+func randomSubnet(n IP4Net, subnetLen uint) IP4Net {
+	count := 1 << (subnetLen - n.PrefixLen)
+	idx := 0
+	if count > 2 {
+		idx = 1 + rand.Intn(count-2)
+	}
+
+	return IP4Net{
+		IP:        n.IP + IP4(idx<<(32-subnetLen)),
+		PrefixLen: subnetLen,
+	}
+}
+
+// overlayDevice is the device a network carries its traffic on.
+type overlayDevice interface {
+	handleSubnetEvents(batch []Event, snapshot bool)
+	peerStatuses() []peerStatus
+	checkReady() error
+	linkName() string
+	linkIntact() bool
+}
+
+// network is a running overlay: its registry, its subnet lease and its
+// vxlan device, or its WireGuard device with the wireguard backend.
+type network struct {
+	cfg      networkConfig
+	sm       *manager
+	dev      *vxlanDevice
+	wg       *wireguardDevice
+	lease    IP4Net
+	iptables ipTablesStatus
+
+	mu    sync.Mutex
+	attrs Attrs
+}
+
+func newNetwork(ctx context.Context, cfg config, nc networkConfig, ns netns.NsHandle, nlh netlinkHandle, extIface *externalInterface) (*network, error) {
+	ipn, err := nc.ipNet()
+	if err != nil {
+		return nil, err
+	}
+
+	var mac net.HardwareAddr
+	if id, err := machineID(); err != nil {
+		logrus.Warningf("[%s] Can't derive a stable VTEP MAC, leaving it to the kernel: %v", nc.Name, err)
+	} else {
+		// instances in different namespaces of one host need distinct MACs
+		mac = vtepMAC(id+cfg.netns, nc.VNI)
+	}
+
+	sm := newManager(cfg, nc)
+	if nc.Backend == backendWireGuard {
+		return newWireGuardNetwork(ctx, nc, sm, ns, nlh, extIface)
+	}
+
+	var secret, nonce []byte
+	if nc.Encryption == encryptionIPsec {
+		if secret, err = sm.ipsecSecret(ctx); err != nil {
+			return nil, fmt.Errorf("failed to get IPsec secret: %v", err)
+		}
+		if nonce, err = newIPsecNonce(); err != nil {
+			return nil, err
+		}
+	}
+
+	devAttrs := vxlanDeviceAttrs{
+		vni:          nc.VNI,
+		name:         fmt.Sprintf("vxlan.%v", nc.VNI),
+		vtepIndex:    extIface.Iface.Index,
+		vtepAddr:     extIface.IfaceAddr,
+		vtepPort:     nc.Port,
+		portLow:      nc.PortLow,
+		portHigh:     nc.PortHigh,
+		udpCSum:      nc.UDPCSum,
+		ttl:          nc.TTL,
+		tos:          nc.TOS,
+		gbp:          nc.GBP != nil,
+		mtu:          nc.MTU,
+		hardwareAddr: mac,
+		mode:         nc.Mode,
+		group:        net.ParseIP(nc.Group).To4(),
+		overlay:      ipn.ToIPNet(),
+		publicIP:     FromIP(extIface.ExtAddr),
+		localNet:     extIface.IfaceNet,
+		ipsecSecret:  secret,
+		ipsecNonce:   nonce,
+	}
+	if nc.Mode == modeBridge {
+		devAttrs.bridge = nc.Bridge
+		devAttrs.gatewayMAC = gatewayMAC(nc.VNI)
+	}
+
+	dev, err := newVxlanDevice(nlh, &devAttrs)
+	if err != nil {
+		return nil, fmt.Errorf("newVXLANDevice err: %v", err)
+	}
+	dev.directRouting = false
+	dev.network = nc.Name
+
+	attrs := Attrs{
+		PublicIP:     FromIP(extIface.ExtAddr),
+		VtepIP:       FromIP(extIface.IfaceAddr),
+		HardwareAddr: dev.link.HardwareAddr,
+		Port:         nc.Port,
+		IPsecNonce:   nonce,
+	}
+
+	sn, err := sm.acquireLease(ctx, ipn, nc.SubnetLen, attrs)
+	if err != nil {
+		return nil, fmt.Errorf("create subnet fail: %v", err)
+	}
+	attrs.Subnet = sn
+	dev.lease = sn
+
+	logrus.Infof("[%s] create subnet: %v, net mask: %v", nc.Name, sn.IP.ToIP(), sn.PrefixLen)
+
+	addr := fmt.Sprintf("%v/32", sn.IP.ToIP())
+	if nc.Mode == modeBridge {
+		// the lease only identifies us to peers; the network is one L2
+		// segment behind the shared gateway
+		if addr, err = nc.gateway(); err != nil {
+			return nil, err
+		}
+	}
+	if err := dev.configure(addr); err != nil {
+		return nil, fmt.Errorf("failed to configure interface %s: %s", dev.link.Attrs().Name, err)
+	}
+
+	return &network{
+		cfg:   nc,
+		sm:    sm,
+		dev:   dev,
+		lease: sn,
+		attrs: attrs,
+	}, nil
+}
+
+// overlay returns the device of the network's backend.
+func (n *network) overlay() overlayDevice {
+	if n.wg != nil {
+		return n.wg
+	}
+	return n.dev
+}
+
+// run starts the subnet watch/handle loop, the lease renewal, the iptables
+// resync loop, the device watch and, in miss mode, the miss responder of the
+// network.
+// In bridge mode it also advertises local workloads and programs remote ones.
+func (n *network) run(ctx context.Context, ns netns.NsHandle) {
+	go handleSubnets(ctx, n.lease, n.sm, n.overlay())
+	go n.renewLease(ctx)
+	rules := forwardRules(n.cfg.Network)
+	if n.cfg.GBP != nil {
+		// the policy has to be evaluated before the network is accepted
+		rules = append(gbpRules(n.cfg.GBP, n.dev.vxlanLink().Name, n.cfg.Mode == modeBridge, n.lease), rules...)
+	}
+	go setupAndEnsureIPTables(ns, rules, iptablesResyncSeconds, &n.iptables)
+	go n.watchLink(ctx, ns)
+	if n.wg != nil {
+		logrus.Infof("[%s] WireGuard PublicKey: %v", n.cfg.Name, n.attrs.PublicKey)
+		return
+	}
+	if n.cfg.Mode == modeMiss {
+		go n.dev.handleMisses(ctx, ns)
+	}
+	if n.cfg.Mode == modeBridge {
+		go n.advertiseEndpoints(ctx, ns)
+		go handleEndpoints(ctx, n.lease, n.sm, n.dev)
+	}
+
+	logrus.Infof("[%s] VXLan HardwareAddr: %v", n.cfg.Name, n.dev.link.HardwareAddr)
+}
+
+// setExtIface moves the network onto a changed external interface: the
+// device is rebuilt for the new VTEP address and our lease is updated so
+// peers send to the right place.
+func (n *network) setExtIface(ctx context.Context, extIface *externalInterface) error {
+	if n.wg != nil {
+		n.wg.setExtIface(FromIP(extIface.ExtAddr), extIface.IfaceNet)
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		attrs := n.attrs
+		attrs.PublicIP = FromIP(extIface.ExtAddr)
+		attrs.VtepIP = FromIP(extIface.IfaceAddr)
+		return n.updateLease(ctx, attrs)
+	}
+
+	devAttrs := n.dev.deviceAttrs()
+	devAttrs.vtepIndex = extIface.Iface.Index
+	devAttrs.vtepAddr = extIface.IfaceAddr
+	devAttrs.publicIP = FromIP(extIface.ExtAddr)
+	devAttrs.localNet = extIface.IfaceNet
+	if devAttrs.ipsecSecret != nil && !devAttrs.vtepAddr.Equal(n.dev.deviceAttrs().vtepAddr) {
+		// the SAs are installed again for the new address and must not reuse
+		// the keys of the old ones
+		nonce, err := newIPsecNonce()
+		if err != nil {
+			return err
+		}
+		devAttrs.ipsecNonce = nonce
+	}
+
+	if err := n.dev.recreate(&devAttrs); err != nil {
+		return fmt.Errorf("failed to recreate vxlan device: %v", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	attrs := n.attrs
+	attrs.PublicIP = FromIP(extIface.ExtAddr)
+	attrs.VtepIP = FromIP(extIface.IfaceAddr)
+	attrs.HardwareAddr = n.dev.vxlanLink().HardwareAddr
+	attrs.IPsecNonce = devAttrs.ipsecNonce
+	return n.updateLease(ctx, attrs)
+}
+
+// restoreDevice recreates a deleted or downed vxlan device with its current
+// attributes and replays all peers onto it.
+func (n *network) restoreDevice(ctx context.Context) error {
+	if n.wg != nil {
+		// the key is kept, the lease stays valid
+		if err := n.wg.recreate(); err != nil {
+			return fmt.Errorf("failed to recreate wireguard device: %v", err)
+		}
+		return nil
+	}
+
+	devAttrs := n.dev.deviceAttrs()
+	if err := n.dev.recreate(&devAttrs); err != nil {
+		return fmt.Errorf("failed to recreate vxlan device: %v", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	mac := n.dev.vxlanLink().HardwareAddr
+	if bytes.Equal(mac, n.attrs.HardwareAddr) {
+		return nil
+	}
+
+	attrs := n.attrs
+	attrs.HardwareAddr = mac
+	return n.updateLease(ctx, attrs)
+}
+
+// renewLease keeps our lease from expiring, renewing it every subnetTTL/2 and
+// retrying failed renewals every leaseRetryInterval.
+func (n *network) renewLease(ctx context.Context) {
+	next := subnetTTL / 2
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
+
+		n.mu.Lock()
+		err := n.sm.renewSubnet(ctx, n.lease, n.attrs)
+		n.mu.Unlock()
+		if err != nil {
+			leaseRenewalFailuresCounter.WithLabelValues(n.cfg.Name).Inc()
+			logrus.Errorf("[%s] Failed to renew lease, retrying in %v: %v", n.cfg.Name, leaseRetryInterval, err)
+			next = leaseRetryInterval
+			continue
+		}
+		next = subnetTTL / 2
+	}
+}
+
+// updateLease writes attrs to our lease. The caller must hold n.mu.
+func (n *network) updateLease(ctx context.Context, attrs Attrs) error {
+	if err := n.sm.updateSubnet(ctx, n.lease, attrs); err != nil {
+		return fmt.Errorf("failed to update lease: %v", err)
+	}
+	n.attrs = attrs
+
+	logrus.Infof("[%s] lease updated: PublicIP: %s VtepIP: %s VtepMAC: %s", n.cfg.Name, attrs.PublicIP.ToIP(), attrs.VtepIP.ToIP(), attrs.HardwareAddr)
+	return nil
+}
+
+func (n *network) status() networkStatus {
+	n.mu.Lock()
+	attrs := n.attrs
+	n.mu.Unlock()
+
+	return networkStatus{
+		Config: n.cfg,
+		Lease: leaseStatus{
+			Subnet:     n.lease.StringSep(".", "/"),
+			PublicIP:   attrs.PublicIP.ToIP().String(),
+			VtepIP:     attrs.VtepIP.ToIP().String(),
+			VtepMAC:    attrs.HardwareAddr.String(),
+			Port:       vxlanPort(attrs.Port),
+			Expiration: n.sm.leaseExpiration(),
+		},
+		Peers: n.overlay().peerStatuses(),
+	}
+}
+
+// healthy reports whether the watch loop made progress within timeout.
+func (n *network) healthy(timeout time.Duration) error {
+	if since := time.Since(n.sm.watchProgress()); since > timeout {
+		return fmt.Errorf("watch loop made no progress for %v", since)
+	}
+	return nil
+}
+
+// ready reports whether this node is actually on the overlay.
+func (n *network) ready() error {
+	if !n.sm.hasLease() {
+		return fmt.Errorf("no subnet lease")
+	}
+	if err := n.overlay().checkReady(); err != nil {
+		return err
+	}
+	if !n.iptables.get() {
+		return fmt.Errorf("iptables rules missing")
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func loadTestNetworks(t *testing.T, config string) ([]networkConfig, error) {
+	f, err := ioutil.TempFile("", "networks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(config); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	return loadNetworks(f.Name())
+}
+
+func TestLoadNetworksOverlap(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{
+			config: `[{"name": "a", "vni": 1, "network": "10.5.0.0/16"}, {"name": "b", "vni": 2, "network": "10.6.0.0/16"}]`,
+		},
+		{
+			config: `[{"name": "a", "vni": 1, "network": "10.5.0.0/16"}, {"name": "b", "vni": 2, "network": "10.5.0.0/16"}]`,
+			err:    `network "b": 10.5.0.0/16 overlaps 10.5.0.0/16 of network "a"`,
+		},
+		{
+			// a smaller network inside a larger one
+			config: `[{"name": "a", "vni": 1, "network": "10.0.0.0/8"}, {"name": "b", "vni": 2, "network": "10.5.0.0/16"}]`,
+			err:    `network "b": 10.5.0.0/16 overlaps 10.0.0.0/8 of network "a"`,
+		},
+		{
+			// and the other way around
+			config: `[{"name": "a", "vni": 1, "network": "10.5.0.0/16"}, {"name": "b", "vni": 2, "network": "10.0.0.0/8"}]`,
+			err:    `network "b": 10.0.0.0/8 overlaps 10.5.0.0/16 of network "a"`,
+		},
+	}
+
+	for _, test := range tests {
+		networks, err := loadTestNetworks(t, test.config)
+		if test.err == "" {
+			if err != nil || len(networks) != 2 {
+				t.Errorf("%s: got %v networks, %v; want 2, nil", test.config, len(networks), err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want %q", test.config, err, test.err)
+		}
+	}
+}
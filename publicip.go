@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// discoverPublicIP asks an echo service, or a cloud metadata endpoint, at url
+// which address this node is reachable on. The response body must be the bare
+// IPv4 address.
+func discoverPublicIP(url string) (net.IP, error) {
+	cli := http.Client{Timeout: 10 * time.Second}
+	resp, err := cli.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(string(body))).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%s returned %q, not an IPv4 address", url, body)
+	}
+	return ip, nil
+}
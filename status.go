@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const defaultStatusSocket = "/var/run/vxlan.sock"
+
+type statusResponse struct {
+	EtcdEndpoint string          `json:"etcdEndpoint"`
+	Netns        string          `json:"netns,omitempty"`
+	Networks     []networkStatus `json:"networks"`
+}
+
+type networkStatus struct {
+	Config networkConfig `json:"config"`
+	Lease  leaseStatus   `json:"lease"`
+	Peers  []peerStatus  `json:"peers"`
+}
+
+type leaseStatus struct {
+	Subnet     string     `json:"subnet"`
+	PublicIP   string     `json:"publicIP"`
+	VtepIP     string     `json:"vtepIP"`
+	VtepMAC    string     `json:"vtepMAC"`
+	Port       int        `json:"port"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+}
+
+type peerStatus struct {
+	Subnet    string `json:"subnet"`
+	PublicIP  string `json:"publicIP"`
+	VtepIP    string `json:"vtepIP"`
+	VtepMAC   string `json:"vtepMAC"`
+	PublicKey string `json:"publicKey,omitempty"`
+	ARP       bool   `json:"arp"`
+	FDB       bool   `json:"fdb"`
+	Flood     bool   `json:"flood"`
+	Route     bool   `json:"route"`
+	IPsec     bool   `json:"ipsec"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// statusSocketPath returns the default status socket of a daemon managing
+// netns, so that daemons serving different namespaces don't collide.
+func statusSocketPath(netns string) string {
+	if netns == "" {
+		return defaultStatusSocket
+	}
+	name := strings.Trim(strings.Replace(netns, "/", "-", -1), "-")
+	return fmt.Sprintf("/var/run/vxlan-%s.sock", name)
+}
+
+// listenStatus listens on the status socket. A socket still answering
+// belongs to another daemon and is left alone; a dead one is replaced.
+func listenStatus(socket string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", socket, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("status socket %s is in use by another daemon, pass a different -statusSocket", socket)
+	}
+
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale status socket %s: %v", socket, err)
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on status socket %s: %v", socket, err)
+	}
+	return l, nil
+}
+
+// serveStatus serves the daemon's view of the world as JSON on l.
+func serveStatus(l net.Listener, cfg config, networks []*network) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		resp := statusResponse{
+			EtcdEndpoint: cfg.etcdEndpoint,
+			Netns:        cfg.netns,
+			Networks:     []networkStatus{},
+		}
+		for _, n := range networks {
+			resp.Networks = append(resp.Networks, n.status())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	logrus.Infof("Serving status on %s", l.Addr())
+	if err := http.Serve(l, mux); err != nil {
+		logrus.Errorf("Status server exited: %v", err)
+	}
+}
+
+// runStatus implements the `vxlan status` subcommand.
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	socket := fs.String("socket", "", "status socket of the running daemon, derived from -netns by default")
+	netns := fs.String("netns", "", "network namespace (path or name) the daemon manages")
+	asJSON := fs.Bool("json", false, "print the raw JSON status")
+	fs.Parse(args)
+	if *socket == "" {
+		*socket = statusSocketPath(*netns)
+	}
+
+	cli := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", *socket)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	resp, err := cli.Get("http://vxlan/status")
+	if err != nil {
+		return fmt.Errorf("failed to query daemon: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("daemon returned %s", resp.Status)
+	}
+
+	var status statusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("failed to decode status: %v", err)
+	}
+
+	if *asJSON {
+		return printJSON(status)
+	}
+
+	printStatus(status)
+	return nil
+}
+
+func printStatus(status statusResponse) {
+	fmt.Printf("etcd: %s\n", status.EtcdEndpoint)
+	if status.Netns != "" {
+		fmt.Printf("netns: %s\n", status.Netns)
+	}
+
+	for _, n := range status.Networks {
+		fmt.Printf("\nnetwork %s (vni %v, %s)\n", n.Config.Name, n.Config.VNI, n.Config.Network)
+		fmt.Printf("lease: %s public ip %s vtep ip %s vtep mac %s port %v", n.Lease.Subnet, n.Lease.PublicIP, n.Lease.VtepIP, n.Lease.VtepMAC, n.Lease.Port)
+		if n.Lease.Expiration != nil {
+			fmt.Printf(" expires %s", n.Lease.Expiration.Format(time.RFC3339))
+		}
+		fmt.Println()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		if n.Config.Backend == backendWireGuard {
+			fmt.Fprintln(w, "SUBNET\tPUBLIC IP\tENDPOINT IP\tPUBLIC KEY\tROUTE\tLAST ERROR")
+			for _, p := range n.Peers {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%s\n", p.Subnet, p.PublicIP, p.VtepIP, p.PublicKey, p.Route, p.LastError)
+			}
+		} else {
+			fmt.Fprintln(w, "SUBNET\tPUBLIC IP\tVTEP IP\tVTEP MAC\tARP\tFDB\tFLOOD\tROUTE\tIPSEC\tLAST ERROR")
+			for _, p := range n.Peers {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%v\t%v\t%v\t%v\t%s\n", p.Subnet, p.PublicIP, p.VtepIP, p.VtepMAC, p.ARP, p.FDB, p.Flood, p.Route, p.IPsec, p.LastError)
+			}
+		}
+		w.Flush()
+	}
+}
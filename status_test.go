@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatusSocketPath(t *testing.T) {
+	tests := map[string]string{
+		"":                       "/var/run/vxlan.sock",
+		"blue":                   "/var/run/vxlan-blue.sock",
+		"/var/run/netns/blue":    "/var/run/vxlan-var-run-netns-blue.sock",
+		"/proc/1234/ns/net":      "/var/run/vxlan-proc-1234-ns-net.sock",
+		"/var/run/netns/blue/":   "/var/run/vxlan-var-run-netns-blue.sock",
+		"/run/docker/netns/abcd": "/var/run/vxlan-run-docker-netns-abcd.sock",
+	}
+	for netns, want := range tests {
+		if got := statusSocketPath(netns); got != want {
+			t.Errorf("statusSocketPath(%q) = %q, want %q", netns, got, want)
+		}
+	}
+}
+
+func TestListenStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "vxlan.sock")
+
+	l, err := listenStatus(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a live daemon keeps its socket
+	if _, err := listenStatus(socket); err == nil {
+		t.Fatal("listened on a socket another daemon is serving")
+	}
+	if _, err := net.Dial("unix", socket); err != nil {
+		t.Fatalf("socket of the first daemon is gone: %v", err)
+	}
+
+	// the socket of a dead one is replaced
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if _, err := os.Stat(socket); err != nil {
+		t.Fatal(err)
+	}
+	l, err = listenStatus(socket)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	l.Close()
+}
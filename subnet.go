@@ -8,6 +8,7 @@ import (
 	"path"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -17,6 +18,7 @@ import (
 var (
 	subnetRegex = regexp.MustCompile(`(\d+\.\d+.\d+.\d+)-(\d+)`)
 	eventAdd    = "add"
+	eventRemove = "remove"
 )
 
 type IP4 uint
@@ -68,25 +70,43 @@ func MakeSubnetKey(sn IP4Net) string {
 }
 
 type Attrs struct {
-	PublicIP     IP4
+	PublicIP IP4
+	// VtepIP is the address of the node's external interface. It differs
+	// from PublicIP when the node is behind NAT.
+	VtepIP       IP4
 	Subnet       IP4Net
 	HardwareAddr net.HardwareAddr
+	// Port is the UDP port the node's device listens on, zero for the
+	// kernel default
+	Port int
+	// PublicKey is the node's WireGuard public key with the wireguard
+	// backend, where Port is its listen port
+	PublicKey string
+	// IPsecNonce is mixed into the keys of the node's SAs, see ipsecDerive
+	IPsecNonce []byte
 }
 
 type manager struct {
-	cli    client.KeysAPI
-	Prefix string
+	cli     client.KeysAPI
+	Prefix  string
+	network string
+
+	mu           sync.Mutex
+	leased       bool
+	expiration   *time.Time
+	lastProgress time.Time
 }
 
-func newManager(cfg config) manager {
+func newManager(cfg config, nc networkConfig) *manager {
 	etcdCli, err := newEtcdClient(cfg)
 	if err != nil {
 		panic(fmt.Sprintf("new etcd client err: %v", err))
 	}
 
-	return manager{
-		cli:    etcdCli,
-		Prefix: "/vxlan",
+	return &manager{
+		cli:     etcdCli,
+		Prefix:  nc.Prefix,
+		network: nc.Name,
 	}
 }
 
@@ -96,6 +116,13 @@ type Event struct {
 	Attrs  Attrs
 }
 
+// eventBatch is what watchSubnets hands over. A snapshot lists every lease
+// in the registry, after the start or a watch error that may have lost events.
+type eventBatch struct {
+	events   []Event
+	snapshot bool
+}
+
 type subnetWatcher struct {
 	Subnet *IP4Net
 }
@@ -114,7 +141,7 @@ func (sw *subnetWatcher) update(evts []Event) []Event {
 	return batch
 }
 
-func watchSubnets(ctx context.Context, sm *manager, ownSn *IP4Net, receiver chan []Event) {
+func watchSubnets(ctx context.Context, sm *manager, ownSn *IP4Net, receiver chan eventBatch) {
 	var index *uint64
 
 	sw := subnetWatcher{
@@ -124,20 +151,25 @@ func watchSubnets(ctx context.Context, sm *manager, ownSn *IP4Net, receiver chan
 	for {
 		var evts []Event
 		var err error
+		// a nil index means the full snapshot is fetched, always hand it over
+		// so the receiver knows the initial state has been seen
+		snapshot := index == nil
 		evts, index, err = sm.watchEvents(ctx, index)
 		if err != nil {
 			logrus.Errorf("Watch subnets: %v", err)
+			etcdWatchErrorsCounter.WithLabelValues(sm.network).Inc()
 			time.Sleep(time.Second)
 			continue
 		}
+		sm.markProgress()
 
 		var batch []Event
 		if len(evts) > 0 {
 			batch = sw.update(evts)
 		}
 
-		if len(batch) > 0 {
-			receiver <- batch
+		if len(batch) > 0 || snapshot {
+			receiver <- eventBatch{events: batch, snapshot: snapshot}
 		}
 	}
 }
@@ -148,6 +180,10 @@ func (m *manager) watchEvents(ctx context.Context, index *uint64) ([]Event, *uin
 	}
 
 	evt, idx, err := m.watchSubnets(ctx, index)
+	if err == context.DeadlineExceeded {
+		// nothing happened within watchTimeoutSeconds, keep watching from the same index
+		return []Event{}, index, nil
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -162,6 +198,9 @@ func (m *manager) watchSubnets(ctx context.Context, since *uint64) (Event, uint6
 		Recursive:  true,
 	}
 
+	ctx, cancel := context.WithTimeout(ctx, watchTimeoutSeconds*time.Second)
+	defer cancel()
+
 	e, err := m.cli.Watcher(key, opts).Next(ctx)
 	if err != nil {
 		return Event{}, 0, err
@@ -176,7 +215,8 @@ func (m *manager) getSubnets(ctx context.Context) ([]Event, *uint64, error) {
 	resp, err := m.cli.Get(ctx, key, &client.GetOptions{Recursive: true, Quorum: true})
 	if err != nil {
 		if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeKeyNotFound {
-			return []Event{}, nil, nil
+			// watch from the current index rather than fetching again
+			return []Event{}, &etcdErr.Index, nil
 		}
 		return nil, nil, err
 	}
@@ -236,7 +276,10 @@ func parseSubnetWatchResponse(resp *client.Response) (Event, error) {
 
 	switch resp.Action {
 	case "delete", "expire":
-		return Event{}, fmt.Errorf("%v %q: not support, skipping", resp.Action, resp.Node.Key)
+		return Event{
+			Type:   eventRemove,
+			Subnet: *sn,
+		}, nil
 
 	default:
 		attrs := &Attrs{}
@@ -254,16 +297,102 @@ func parseSubnetWatchResponse(resp *client.Response) (Event, error) {
 	}
 }
 
-func (m *manager) createSubnet(ctx context.Context, sn IP4Net, attrs Attrs) error {
+// acquireLease leases a subnet of n for attrs.PublicIP. A reservation bound
+// to that public IP is always used; otherwise a random subnet that is not
+// reserved for another node is picked.
+func (m *manager) acquireLease(ctx context.Context, n IP4Net, subnetLen uint, attrs Attrs) (IP4Net, error) {
+	reservations, err := m.getReservations(ctx)
+	if err != nil {
+		return IP4Net{}, fmt.Errorf("failed to get reservations: %v", err)
+	}
+
+	reserved := map[IP4Net]bool{}
+	for _, r := range reservations {
+		if r.PublicIP == attrs.PublicIP {
+			logrus.Infof("using subnet %s reserved for %s", r.Subnet.StringSep(".", "/"), r.PublicIP.ToIP())
+			attrs.Subnet = r.Subnet
+			return r.Subnet, m.claimSubnet(ctx, r.Subnet, attrs)
+		}
+		reserved[r.Subnet] = true
+	}
+
+	for i := 0; i < maxLeaseAttempts; i++ {
+		sn := randomSubnet(n, subnetLen)
+		if reserved[sn] {
+			continue
+		}
+
+		attrs.Subnet = sn
+		err := m.createSubnet(ctx, sn, attrs, subnetTTL)
+		if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeNodeExist {
+			continue
+		}
+		return sn, err
+	}
+
+	return IP4Net{}, fmt.Errorf("no free subnet found after %v attempts", maxLeaseAttempts)
+}
+
+// createSubnet writes our lease for sn, failing if sn is leased already.
+func (m *manager) createSubnet(ctx context.Context, sn IP4Net, attrs Attrs, ttl time.Duration) error {
+	return m.setSubnet(ctx, sn, attrs, &client.SetOptions{PrevExist: client.PrevNoExist, TTL: ttl})
+}
+
+// claimSubnet writes our lease for the subnet sn reserved for us, without a
+// TTL. A lease we left behind is replaced, one held by another node is not:
+// it has to expire or be deleted first.
+func (m *manager) claimSubnet(ctx context.Context, sn IP4Net, attrs Attrs) error {
 	key := path.Join(m.Prefix, "subnets", MakeSubnetKey(sn))
-	value, err := json.Marshal(attrs)
+	resp, err := m.cli.Get(ctx, key, &client.GetOptions{Quorum: true})
+	if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeKeyNotFound {
+		return m.createSubnet(ctx, sn, attrs, 0)
+	}
 	if err != nil {
 		return err
 	}
 
-	opts := &client.SetOptions{
-		PrevExist: client.PrevNoExist,
-		TTL:       time.Hour * 24,
+	l, err := nodeToLease(resp.Node)
+	if err != nil {
+		return err
+	}
+	if l.Attrs.PublicIP != attrs.PublicIP {
+		return fmt.Errorf("subnet %s is reserved for us but leased by %s", sn.StringSep(".", "/"), l.Attrs.PublicIP.ToIP())
+	}
+
+	// fails if the lease changed hands since we looked at it
+	return m.setSubnet(ctx, sn, attrs, &client.SetOptions{PrevIndex: resp.Node.ModifiedIndex})
+}
+
+// updateSubnet rewrites the attrs of our existing lease for sn, keeping it
+// free of a TTL if it is a reserved one.
+func (m *manager) updateSubnet(ctx context.Context, sn IP4Net, attrs Attrs) error {
+	ttl := subnetTTL
+	if m.leaseExpiration() == nil {
+		ttl = 0
+	}
+	return m.setSubnet(ctx, sn, attrs, &client.SetOptions{PrevExist: client.PrevExist, TTL: ttl})
+}
+
+// renewSubnet extends our lease for sn before its TTL runs out. A lease that
+// expired or was deleted in the meantime is acquired again.
+func (m *manager) renewSubnet(ctx context.Context, sn IP4Net, attrs Attrs) error {
+	err := m.updateSubnet(ctx, sn, attrs)
+	if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeKeyNotFound {
+		logrus.Warningf("[%s] lease for %s is gone, acquiring it again", m.network, sn.StringSep(".", "/"))
+		ttl := subnetTTL
+		if m.leaseExpiration() == nil {
+			ttl = 0
+		}
+		return m.createSubnet(ctx, sn, attrs, ttl)
+	}
+	return err
+}
+
+func (m *manager) setSubnet(ctx context.Context, sn IP4Net, attrs Attrs, opts *client.SetOptions) error {
+	key := path.Join(m.Prefix, "subnets", MakeSubnetKey(sn))
+	value, err := json.Marshal(attrs)
+	if err != nil {
+		return err
 	}
 
 	resp, err := m.cli.Set(ctx, key, string(value), opts)
@@ -273,18 +402,193 @@ func (m *manager) createSubnet(ctx context.Context, sn IP4Net, attrs Attrs) erro
 
 	if resp.Node.Expiration != nil {
 		logrus.Infof("subnet key expired in: %v", resp.Node.Expiration)
+		leaseExpiryGauge.WithLabelValues(m.network).Set(float64(resp.Node.Expiration.Unix()))
 	}
+
+	m.mu.Lock()
+	m.leased = true
+	m.expiration = resp.Node.Expiration
+	m.mu.Unlock()
 	return nil
 }
 
-func handleSubnets(ctx context.Context, sn IP4Net, sm *manager, dev *vxlanDevice) {
-	evts := make(chan []Event)
+// leaseExpiration returns when our lease expires, nil if it does not.
+func (m *manager) leaseExpiration() *time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.expiration
+}
+
+func (m *manager) hasLease() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.leased
+}
+
+func (m *manager) markProgress() {
+	m.mu.Lock()
+	m.lastProgress = time.Now()
+	m.mu.Unlock()
+}
+
+// watchProgress returns the last time the watch loop completed a round.
+func (m *manager) watchProgress() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastProgress
+}
+
+// lease is a subnet lease as stored in the registry.
+type lease struct {
+	Subnet     IP4Net
+	Attrs      Attrs
+	Expiration *time.Time
+}
+
+func (l lease) status() leaseStatus {
+	return leaseStatus{
+		Subnet:     l.Subnet.StringSep(".", "/"),
+		PublicIP:   l.Attrs.PublicIP.ToIP().String(),
+		VtepIP:     l.Attrs.VtepIP.ToIP().String(),
+		VtepMAC:    l.Attrs.HardwareAddr.String(),
+		Port:       vxlanPort(l.Attrs.Port),
+		Expiration: l.Expiration,
+	}
+}
+
+func nodeToLease(node *client.Node) (*lease, error) {
+	sn := ParseSubnetKey(node.Key)
+	if sn == nil {
+		return nil, fmt.Errorf("failed to parse subnet key %s", node.Key)
+	}
+
+	attrs := &Attrs{}
+	if err := json.Unmarshal([]byte(node.Value), attrs); err != nil {
+		return nil, err
+	}
+
+	return &lease{
+		Subnet:     *sn,
+		Attrs:      *attrs,
+		Expiration: node.Expiration,
+	}, nil
+}
+
+func (m *manager) getLeases(ctx context.Context) ([]lease, error) {
+	key := path.Join(m.Prefix, "subnets")
+	resp, err := m.cli.Get(ctx, key, &client.GetOptions{Recursive: true, Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeKeyNotFound {
+			return []lease{}, nil
+		}
+		return nil, err
+	}
+
+	leases := []lease{}
+	for _, node := range resp.Node.Nodes {
+		l, err := nodeToLease(node)
+		if err != nil {
+			logrus.Warningf("Ignoring bad subnet node: %v", err)
+			continue
+		}
+
+		leases = append(leases, *l)
+	}
+
+	return leases, nil
+}
+
+func (m *manager) getLease(ctx context.Context, sn IP4Net) (*lease, error) {
+	key := path.Join(m.Prefix, "subnets", MakeSubnetKey(sn))
+	resp, err := m.cli.Get(ctx, key, &client.GetOptions{Quorum: true})
+	if err != nil {
+		return nil, err
+	}
+
+	return nodeToLease(resp.Node)
+}
+
+func (m *manager) deleteLease(ctx context.Context, sn IP4Net) error {
+	key := path.Join(m.Prefix, "subnets", MakeSubnetKey(sn))
+	_, err := m.cli.Delete(ctx, key, nil)
+	return err
+}
+
+// reservation binds a subnet to the node with PublicIP.
+type reservation struct {
+	Subnet   IP4Net
+	PublicIP IP4
+}
+
+func (m *manager) getReservations(ctx context.Context) ([]reservation, error) {
+	key := path.Join(m.Prefix, "reservations")
+	resp, err := m.cli.Get(ctx, key, &client.GetOptions{Recursive: true, Quorum: true})
+	if err != nil {
+		if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeKeyNotFound {
+			return []reservation{}, nil
+		}
+		return nil, err
+	}
+
+	reservations := []reservation{}
+	for _, node := range resp.Node.Nodes {
+		sn := ParseSubnetKey(node.Key)
+		if sn == nil {
+			logrus.Warningf("Ignoring bad reservation node: %s", node.Key)
+			continue
+		}
+
+		r := reservation{}
+		if err := json.Unmarshal([]byte(node.Value), &r); err != nil {
+			logrus.Warningf("Ignoring bad reservation node: %v", err)
+			continue
+		}
+		r.Subnet = *sn
+
+		reservations = append(reservations, r)
+	}
+
+	return reservations, nil
+}
+
+// reserveSubnet binds sn to the node with publicIP. It fails if sn is already
+// reserved, or leased by another node.
+func (m *manager) reserveSubnet(ctx context.Context, sn IP4Net, publicIP IP4) error {
+	l, err := m.getLease(ctx, sn)
+	if err == nil && l.Attrs.PublicIP != publicIP {
+		return fmt.Errorf("subnet %s is leased by %s, delete the lease first", sn.StringSep(".", "/"), l.Attrs.PublicIP.ToIP())
+	}
+	if etcdErr, ok := err.(client.Error); err != nil && (!ok || etcdErr.Code != client.ErrorCodeKeyNotFound) {
+		return err
+	}
+
+	key := path.Join(m.Prefix, "reservations", MakeSubnetKey(sn))
+	value, err := json.Marshal(reservation{
+		Subnet:   sn,
+		PublicIP: publicIP,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.cli.Set(ctx, key, string(value), &client.SetOptions{PrevExist: client.PrevNoExist})
+	return err
+}
+
+func (m *manager) unreserveSubnet(ctx context.Context, sn IP4Net) error {
+	key := path.Join(m.Prefix, "reservations", MakeSubnetKey(sn))
+	_, err := m.cli.Delete(ctx, key, nil)
+	return err
+}
+
+func handleSubnets(ctx context.Context, sn IP4Net, sm *manager, dev overlayDevice) {
+	evts := make(chan eventBatch)
 	go func() {
 		watchSubnets(ctx, sm, &sn, evts)
 		logrus.Info("watch subnets exit")
 	}()
 
 	for evtBatch := range evts {
-		dev.handleSubnetEvents(evtBatch)
+		dev.handleSubnetEvents(evtBatch.events, evtBatch.snapshot)
 	}
 }
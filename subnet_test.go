@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestManager() (*manager, *fakeKeysAPI) {
+	reg := newFakeKeysAPI()
+	return &manager{cli: reg, Prefix: "/vxlan", network: "test"}, reg
+}
+
+func testSubnet(s string) IP4Net {
+	_, ipn, _ := net.ParseCIDR(s)
+	prefixLen, _ := ipn.Mask.Size()
+	return IP4Net{IP: FromIP(ipn.IP), PrefixLen: uint(prefixLen)}
+}
+
+func TestAcquireLeaseReserved(t *testing.T) {
+	ctx := context.Background()
+	sm, _ := newTestManager()
+	sn := testSubnet("10.5.3.0/24")
+	us := Attrs{PublicIP: FromIP(net.IPv4(192, 168, 100, 1))}
+
+	if err := sm.reserveSubnet(ctx, sn, us.PublicIP); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := sm.acquireLease(ctx, testSubnet("10.5.0.0/16"), 24, us)
+	if err != nil || got != sn {
+		t.Fatalf("got %v, %v; want %v, nil", got, err, sn)
+	}
+	l, err := sm.getLease(ctx, sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Attrs.PublicIP != us.PublicIP || l.Expiration != nil {
+		t.Fatalf("unexpected lease %+v", l)
+	}
+
+	// a restart claims the lease it left behind
+	if _, err := sm.acquireLease(ctx, testSubnet("10.5.0.0/16"), 24, us); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquireLeaseReservedHeldByOther(t *testing.T) {
+	ctx := context.Background()
+	sm, _ := newTestManager()
+	sn := testSubnet("10.5.3.0/24")
+	us := Attrs{PublicIP: FromIP(net.IPv4(192, 168, 100, 1))}
+	other := Attrs{PublicIP: FromIP(net.IPv4(192, 168, 100, 2)), Subnet: sn}
+
+	// the subnet was leased before it was reserved for us
+	if err := sm.createSubnet(ctx, sn, other, subnetTTL); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.reserveSubnet(ctx, sn, us.PublicIP); err == nil {
+		t.Fatal("reserved a subnet leased by another node")
+	}
+	if err := sm.reserveSubnet(ctx, sn, other.PublicIP); err != nil {
+		t.Fatalf("failed to reserve the subnet for its holder: %v", err)
+	}
+	sm.unreserveSubnet(ctx, sn)
+
+	// a reservation written before the check existed, or raced with the lease
+	reservation := `{"Subnet":{"IP":168100608,"PrefixLen":24},"PublicIP":3232261121}`
+	if _, err := sm.cli.Set(ctx, "/vxlan/reservations/10.5.3.0-24", reservation, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sm.acquireLease(ctx, testSubnet("10.5.0.0/16"), 24, us); err == nil {
+		t.Fatal("took over a lease held by another node")
+	}
+	l, err := sm.getLease(ctx, sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Attrs.PublicIP != other.PublicIP || l.Expiration == nil {
+		t.Fatalf("lease of the other node changed: %+v", l)
+	}
+}
+
+func TestAcquireLeaseSkipsReserved(t *testing.T) {
+	ctx := context.Background()
+	sm, _ := newTestManager()
+	us := Attrs{PublicIP: FromIP(net.IPv4(192, 168, 100, 1))}
+
+	// the network has room for two subnets besides the first and last one,
+	// one of them reserved for another node
+	if err := sm.reserveSubnet(ctx, testSubnet("10.5.1.0/24"), FromIP(net.IPv4(192, 168, 100, 2))); err != nil {
+		t.Fatal(err)
+	}
+	sn, err := sm.acquireLease(ctx, testSubnet("10.5.0.0/22"), 24, us)
+	if err != nil || sn != testSubnet("10.5.2.0/24") {
+		t.Fatalf("got %v, %v; want 10.5.2.0/24", sn, err)
+	}
+	if exp := sm.leaseExpiration(); exp == nil || exp.Before(time.Now()) {
+		t.Fatalf("unreserved lease has no TTL: %v", exp)
+	}
+}
+
+func TestHandleSubnetsResyncsAfterWatchError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sm, reg := newTestManager()
+	dev, _ := newTestDevice(t, modeUnicast)
+	if err := sm.createSubnet(ctx, testPeerSn, testPeer, subnetTTL); err != nil {
+		t.Fatal(err)
+	}
+	go handleSubnets(ctx, dev.lease, sm, dev)
+
+	waitPeers := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(dev.peerStatuses()) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %v peers, want %v", len(dev.peerStatuses()), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitPeers(1)
+
+	// the removal happens while the watch is broken and is never seen as an
+	// event
+	reg.failWatch(errors.New("etcd cluster is unavailable"))
+	if err := sm.deleteLease(ctx, testPeerSn); err != nil {
+		t.Fatal(err)
+	}
+	waitPeers(0)
+}
+
+func TestRenewSubnet(t *testing.T) {
+	ctx := context.Background()
+	sm, reg := newTestManager()
+	sn := testSubnet("10.5.3.0/24")
+	us := Attrs{PublicIP: FromIP(net.IPv4(192, 168, 100, 1)), Subnet: sn}
+	if err := sm.createSubnet(ctx, sn, us, subnetTTL); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.renewSubnet(ctx, sn, us); err != nil {
+		t.Fatal(err)
+	}
+
+	// a lease that expired before it was renewed is acquired again
+	if !reg.expire("/vxlan/subnets/" + MakeSubnetKey(sn)) {
+		t.Fatal("lease not found")
+	}
+	if err := sm.renewSubnet(ctx, sn, us); err != nil {
+		t.Fatal(err)
+	}
+	l, err := sm.getLease(ctx, sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Attrs.PublicIP != us.PublicIP || l.Expiration == nil {
+		t.Fatalf("lease not acquired again with a TTL: %+v", l)
+	}
+}
+
+func TestHandleSubnetsKeepsRenewedPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sm, reg := newTestManager()
+	peerSm := &manager{cli: reg, Prefix: "/vxlan", network: "test"}
+	dev, _ := newTestDevice(t, modeUnicast)
+	if err := peerSm.createSubnet(ctx, testPeerSn, testPeer, subnetTTL); err != nil {
+		t.Fatal(err)
+	}
+	go handleSubnets(ctx, dev.lease, sm, dev)
+
+	waitPeers := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(dev.peerStatuses()) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %v peers, want %v", len(dev.peerStatuses()), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitPeers(1)
+
+	// the peer's lease runs out just before its renewal acquires it again
+	reg.expire("/vxlan/subnets/" + MakeSubnetKey(testPeerSn))
+	if err := peerSm.renewSubnet(ctx, testPeerSn, testPeer); err != nil {
+		t.Fatal(err)
+	}
+
+	// once a later lease shows up, the expiry and renewal have been handled
+	other := testSubnet("10.5.3.0/24")
+	if err := sm.createSubnet(ctx, other, Attrs{PublicIP: FromIP(net.IPv4(192, 168, 100, 3)), Subnet: other}, subnetTTL); err != nil {
+		t.Fatal(err)
+	}
+	waitPeers(2)
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if _, ok := dev.peers[testPeerSn]; !ok {
+		t.Fatalf("renewed peer dropped: %v", dev.peers)
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	backendVxlan     = "vxlan"
+	backendWireGuard = "wireguard"
+
+	defaultWireGuardPort = 51820
+)
+
+// wireguardClient is the subset of wgctrl operations used to configure the
+// WireGuard device. *wgctrl.Client satisfies it.
+type wireguardClient interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+}
+
+var _ wireguardClient = &wgctrl.Client{}
+
+// newWireGuardClient returns a wgctrl client operating inside ns. The socket
+// keeps the namespace of the thread it was opened on.
+func newWireGuardClient(ns netns.NsHandle) (*wgctrl.Client, error) {
+	type result struct {
+		c   *wgctrl.Client
+		err error
+	}
+
+	ch := make(chan result)
+	go func() {
+		if err := enterNetns(ns); err != nil {
+			ch <- result{nil, err}
+			return
+		}
+		c, err := wgctrl.New()
+		ch <- result{c, err}
+	}()
+
+	r := <-ch
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to create wireguard client: %v", r.err)
+	}
+	return r.c, nil
+}
+
+type wireguardDevice struct {
+	nlh        netlinkHandle
+	wg         wireguardClient
+	network    string
+	name       string
+	mtu        int
+	listenPort int
+	key        wgtypes.Key
+	addr       string
+
+	mu       sync.Mutex
+	link     netlink.Link
+	publicIP IP4
+	localNet *net.IPNet
+	peers    map[IP4Net]*wgPeer
+	synced   bool
+}
+
+// wgPeer records what has been configured for a remote subnet.
+type wgPeer struct {
+	attrs   Attrs
+	key     wgtypes.Key
+	peer    bool
+	route   bool
+	lastErr error
+}
+
+// newWireGuardNetwork sets up a network on the WireGuard backend: the same
+// registry and lease as with vxlan, but peers are WireGuard peers.
+func newWireGuardNetwork(ctx context.Context, nc networkConfig, sm *manager, ns netns.NsHandle, nlh netlinkHandle, extIface *externalInterface) (*network, error) {
+	ipn, err := nc.ipNet()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newWireGuardClient(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := newWireGuardDevice(nlh, client, fmt.Sprintf("wg.%v", nc.VNI), nc.MTU, nc.Port)
+	if err != nil {
+		return nil, fmt.Errorf("newWireGuardDevice err: %v", err)
+	}
+	dev.network = nc.Name
+	dev.publicIP = FromIP(extIface.ExtAddr)
+	dev.localNet = extIface.IfaceNet
+
+	attrs := Attrs{
+		PublicIP:  FromIP(extIface.ExtAddr),
+		VtepIP:    FromIP(extIface.IfaceAddr),
+		Port:      dev.listenPort,
+		PublicKey: dev.key.PublicKey().String(),
+	}
+
+	sn, err := sm.acquireLease(ctx, ipn, nc.SubnetLen, attrs)
+	if err != nil {
+		return nil, fmt.Errorf("create subnet fail: %v", err)
+	}
+	attrs.Subnet = sn
+
+	logrus.Infof("[%s] create subnet: %v, net mask: %v", nc.Name, sn.IP.ToIP(), sn.PrefixLen)
+
+	if err := dev.configure(fmt.Sprintf("%v/32", sn.IP.ToIP())); err != nil {
+		return nil, fmt.Errorf("failed to configure interface %s: %s", dev.name, err)
+	}
+
+	return &network{
+		cfg:   nc,
+		sm:    sm,
+		wg:    dev,
+		lease: sn,
+		attrs: attrs,
+	}, nil
+}
+
+func newWireGuardDevice(nlh netlinkHandle, wg wireguardClient, name string, mtu, listenPort int) (*wireguardDevice, error) {
+	if listenPort == 0 {
+		listenPort = defaultWireGuardPort
+	}
+
+	dev := &wireguardDevice{
+		nlh:        nlh,
+		wg:         wg,
+		name:       name,
+		mtu:        mtu,
+		listenPort: listenPort,
+		peers:      make(map[IP4Net]*wgPeer),
+	}
+
+	link, err := dev.ensureLink()
+	if err != nil {
+		return nil, err
+	}
+	dev.link = link
+
+	// keep the key of an existing device so that peers don't have to
+	// relearn it after a restart
+	existing, err := wg.Device(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get wireguard device %s: %v", name, err)
+	}
+	if existing.PrivateKey != (wgtypes.Key{}) {
+		dev.key = existing.PrivateKey
+	} else if dev.key, err = wgtypes.GeneratePrivateKey(); err != nil {
+		return nil, fmt.Errorf("failed to generate wireguard key: %v", err)
+	}
+
+	return dev, nil
+}
+
+func (dev *wireguardDevice) ensureLink() (netlink.Link, error) {
+	err := dev.nlh.LinkAdd(&netlink.Wireguard{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: dev.name,
+			MTU:  dev.mtu,
+		},
+	})
+	if err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("failed to create wireguard interface %s: %v", dev.name, err)
+	}
+
+	link, err := dev.nlh.LinkByName(dev.name)
+	if err != nil {
+		return nil, fmt.Errorf("can't locate wireguard interface %s: %v", dev.name, err)
+	}
+	if link.Type() != "wireguard" {
+		return nil, fmt.Errorf("%s already exists and is a %s, not wireguard", dev.name, link.Type())
+	}
+
+	return link, nil
+}
+
+// configure sets up the device with our key and address. Peers left from a
+// previous run are removed, known ones are configured again by the caller.
+func (dev *wireguardDevice) configure(ipn string) error {
+	dev.addr = ipn
+
+	err := dev.wg.ConfigureDevice(dev.name, wgtypes.Config{
+		PrivateKey:   &dev.key,
+		ListenPort:   &dev.listenPort,
+		ReplacePeers: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure wireguard interface %s: %v", dev.name, err)
+	}
+
+	if err := ensureV4AddressOnLink(dev.nlh, ipn, dev.link); err != nil {
+		return fmt.Errorf("failed to ensure address of interface %s: %s", dev.name, err)
+	}
+
+	if err := dev.nlh.LinkSetUp(dev.link); err != nil {
+		return fmt.Errorf("failed to set interface %s to UP state: %s", dev.name, err)
+	}
+
+	return nil
+}
+
+// recreate restores a deleted or downed device with our key and address and
+// replays all known peers onto it.
+func (dev *wireguardDevice) recreate() error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	defer dev.updatePeerMetrics()
+
+	link, err := dev.ensureLink()
+	if err != nil {
+		return err
+	}
+	dev.link = link
+
+	if err := dev.configure(dev.addr); err != nil {
+		return err
+	}
+
+	dev.replayPeers()
+	return nil
+}
+
+// setExtIface updates our view of the external network and reconfigures
+// the peers whose endpoint depends on it.
+func (dev *wireguardDevice) setExtIface(publicIP IP4, localNet *net.IPNet) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	defer dev.updatePeerMetrics()
+
+	dev.publicIP = publicIP
+	dev.localNet = localNet
+	dev.replayPeers()
+}
+
+// replayPeers configures all known peers again. The caller must hold dev.mu.
+func (dev *wireguardDevice) replayPeers() {
+	logrus.Infof("replaying %v peers onto %s", len(dev.peers), dev.name)
+	for sn, p := range dev.peers {
+		dev.addPeer(sn, p.attrs)
+	}
+}
+
+func (dev *wireguardDevice) linkName() string {
+	return dev.name
+}
+
+// linkIntact reports whether the device we configured still exists and is up.
+func (dev *wireguardDevice) linkIntact() bool {
+	dev.mu.Lock()
+	index := dev.link.Attrs().Index
+	dev.mu.Unlock()
+
+	link, err := dev.nlh.LinkByName(dev.name)
+	if err != nil {
+		return false
+	}
+
+	return link.Attrs().Index == index && link.Attrs().Flags&net.FlagUp != 0
+}
+
+// handleSubnetEvents applies a batch of subnet events. A snapshot replaces
+// all known peers: those missing from it were removed while we weren't
+// watching.
+func (dev *wireguardDevice) handleSubnetEvents(batch []Event, snapshot bool) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	defer dev.updatePeerMetrics()
+
+	// the first batch is always the initial snapshot of the registry
+	dev.synced = true
+
+	if snapshot {
+		seen := map[IP4Net]bool{}
+		for _, e := range batch {
+			seen[e.Subnet] = true
+		}
+		for sn := range dev.peers {
+			if !seen[sn] {
+				dev.removePeer(sn)
+			}
+		}
+	}
+
+	for _, event := range batch {
+		switch event.Type {
+		case eventAdd:
+			dev.addPeer(event.Subnet, event.Attrs)
+		case eventRemove:
+			dev.removePeer(event.Subnet)
+		default:
+			logrus.Infof("invalid event type: %v\n", event.Type)
+		}
+	}
+}
+
+// addPeer configures the WireGuard peer for a remote subnet, with the subnet
+// as its allowed IPs, and routes the subnet through the device. The caller
+// must hold dev.mu.
+func (dev *wireguardDevice) addPeer(sn IP4Net, attrs Attrs) {
+	if old, ok := dev.peers[sn]; ok && old.attrs.PublicKey != attrs.PublicKey {
+		// the node was replaced, don't leave its old key allowed
+		dev.removePeer(sn)
+	}
+
+	p := &wgPeer{attrs: attrs}
+	dev.peers[sn] = p
+
+	key, err := wgtypes.ParseKey(attrs.PublicKey)
+	if err != nil {
+		// a vxlan node in the same registry
+		err = fmt.Errorf("peer has no valid WireGuard public key: %v", err)
+		logrus.Errorf("not configuring subnet %s: %v", sn.StringSep(".", "/"), err)
+		p.lastErr = err
+		return
+	}
+	p.key = key
+
+	port := attrs.Port
+	if port == 0 {
+		port = defaultWireGuardPort
+	}
+	endpoint := &net.UDPAddr{IP: peerAddr(attrs, dev.publicIP, dev.localNet), Port: port}
+	logrus.Infof("adding subnet: %s PublicIP: %s Endpoint: %s PublicKey: %s", sn.StringSep(".", "/"), attrs.PublicIP.ToIP(), endpoint, attrs.PublicKey)
+
+	err = dev.wg.ConfigureDevice(dev.name, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:         key,
+			Endpoint:          endpoint,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        []net.IPNet{*sn.ToIPNet()},
+		}},
+	})
+	observeOp(dev.network, "AddWireGuardPeer", err)
+	if err != nil {
+		logrus.Errorf("failed to add wireguard peer %s: %v", attrs.PublicKey, err)
+		p.lastErr = err
+		return
+	}
+	p.peer = true
+
+	route := dev.peerRoute(sn)
+	err = dev.nlh.RouteReplace(&route)
+	observeOp(dev.network, "RouteReplace", err)
+	if err != nil {
+		logrus.Errorf("failed to add route %s via %s: %v", route.Dst, dev.name, err)
+		p.lastErr = err
+		return
+	}
+	p.route = true
+}
+
+func (dev *wireguardDevice) peerRoute(sn IP4Net) netlink.Route {
+	return netlink.Route{
+		LinkIndex: dev.link.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       sn.ToIPNet(),
+	}
+}
+
+// removePeer removes the route and the WireGuard peer of a remote subnet.
+// The caller must hold dev.mu.
+func (dev *wireguardDevice) removePeer(sn IP4Net) {
+	p, ok := dev.peers[sn]
+	if !ok {
+		return
+	}
+	delete(dev.peers, sn)
+
+	logrus.Infof("removing subnet: %s PublicIP: %s PublicKey: %s", sn.StringSep(".", "/"), p.attrs.PublicIP.ToIP(), p.attrs.PublicKey)
+
+	if p.route {
+		route := dev.peerRoute(sn)
+		err := dev.nlh.RouteDel(&route)
+		observeOp(dev.network, "RouteDel", err)
+		if err != nil {
+			logrus.Errorf("failed to delete route %s via %s: %v", route.Dst, dev.name, err)
+		}
+	}
+
+	if p.peer {
+		err := dev.wg.ConfigureDevice(dev.name, wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{{PublicKey: p.key, Remove: true}},
+		})
+		observeOp(dev.network, "RemoveWireGuardPeer", err)
+		if err != nil {
+			logrus.Errorf("failed to remove wireguard peer %s: %v", p.attrs.PublicKey, err)
+		}
+	}
+}
+
+func (dev *wireguardDevice) updatePeerMetrics() {
+	var peers, routes int
+	for _, p := range dev.peers {
+		if p.peer {
+			peers++
+		}
+		if p.route {
+			routes++
+		}
+	}
+
+	peersGauge.WithLabelValues(dev.network).Set(float64(len(dev.peers)))
+	programmedEntriesGauge.WithLabelValues(dev.network, "wireguard_peer").Set(float64(peers))
+	programmedEntriesGauge.WithLabelValues(dev.network, "route").Set(float64(routes))
+}
+
+// peerStatuses returns a snapshot of the peer table.
+func (dev *wireguardDevice) peerStatuses() []peerStatus {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	peers := make([]peerStatus, 0, len(dev.peers))
+	for sn, p := range dev.peers {
+		ps := peerStatus{
+			Subnet:    sn.StringSep(".", "/"),
+			PublicIP:  p.attrs.PublicIP.ToIP().String(),
+			VtepIP:    peerAddr(p.attrs, dev.publicIP, dev.localNet).String(),
+			PublicKey: p.attrs.PublicKey,
+			Route:     p.route,
+		}
+		if p.lastErr != nil {
+			ps.LastError = p.lastErr.Error()
+		}
+		peers = append(peers, ps)
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Subnet < peers[j].Subnet })
+	return peers
+}
+
+// checkReady reports whether the device is up with our address and all
+// peers known so far are configured.
+func (dev *wireguardDevice) checkReady() error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	link, err := dev.nlh.LinkByIndex(dev.link.Attrs().Index)
+	if err != nil {
+		return fmt.Errorf("failed to find %s: %v", dev.name, err)
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("%s is not up", dev.name)
+	}
+
+	want, err := netlink.ParseAddr(dev.addr)
+	if err != nil {
+		return fmt.Errorf("%s is not configured", dev.name)
+	}
+	addrs, err := dev.nlh.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr.Equal(*want) {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s does not have address %s", dev.name, dev.addr)
+	}
+
+	if !dev.synced {
+		return fmt.Errorf("initial subnets not handled yet")
+	}
+	for sn, p := range dev.peers {
+		if !p.peer || !p.route {
+			return fmt.Errorf("subnet %s not fully programmed", sn.StringSep(".", "/"))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeWireGuard is an in-memory wgctrl client for a single device.
+type fakeWireGuard struct {
+	device  wgtypes.Device
+	configs []wgtypes.Config
+}
+
+func (f *fakeWireGuard) Device(name string) (*wgtypes.Device, error) {
+	d := f.device
+	d.Name = name
+	return &d, nil
+}
+
+func (f *fakeWireGuard) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	f.configs = append(f.configs, cfg)
+	if cfg.PrivateKey != nil {
+		f.device.PrivateKey = *cfg.PrivateKey
+	}
+	if cfg.ReplacePeers {
+		f.device.Peers = nil
+	}
+	for _, pc := range cfg.Peers {
+		if pc.Remove {
+			continue
+		}
+		f.device.Peers = append(f.device.Peers, wgtypes.Peer{PublicKey: pc.PublicKey})
+	}
+	return nil
+}
+
+func TestWireGuardConfigureDropsStalePeers(t *testing.T) {
+	stale, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := &fakeWireGuard{device: wgtypes.Device{Peers: []wgtypes.Peer{{PublicKey: stale.PublicKey()}}}}
+
+	dev, err := newWireGuardDevice(newFakeNetlink(), wg, "wg.1", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.configure("10.5.1.0/32"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer of the previous run is no longer in the registry
+	if len(wg.device.Peers) != 0 {
+		t.Fatalf("peers of a previous run left: %v", wg.device.Peers)
+	}
+}